@@ -0,0 +1,118 @@
+package openid
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerifyMethod is the way an assertion was verified.
+type VerifyMethod int
+
+const (
+	// VerifiedViaAssociation is verified with the secret of an association.
+	VerifiedViaAssociation VerifyMethod = iota + 1
+	// VerifiedViaDirect is verified by asking the OpenID Server directly,
+	// with check_authentication.
+	VerifiedViaDirect
+)
+
+// String return the name of the VerifyMethod
+func (m VerifyMethod) String() string {
+	switch m {
+	case VerifiedViaAssociation:
+		return "association"
+	case VerifiedViaDirect:
+		return "direct"
+	default:
+		return fmt.Sprintf("VerifyMethod(%d)", int(m))
+	}
+}
+
+// Assertion is a verified positive assertion from an OpenID Server.
+type Assertion struct {
+	// Values holds the openid values without the "openid." prefix, like
+	// "claimed_id" or "sreg.email". All are signed but mode, ns, signed
+	// and sig.
+	Values map[string]string
+	// Unsigned holds the values the OpenID Server did not sign, only filled
+	// when enabled by SetUnsignedExtensions. Never trust them.
+	Unsigned map[string]string
+	// AX holds the signed AX attribute values keyed by attribute alias,
+	// multi-valued attributes keep all their values.
+	AX map[string][]string
+	// Method is the way the assertion was verified.
+	Method VerifyMethod
+	// DisplayIdentifier is the identifier the user entered at login with
+	// CheckIDSetupIdentifier, like "me.example.com", or else the claimed_id
+	// without its fragment. It is for display only, the claimed_id is the
+	// identifier of the user.
+	DisplayIdentifier string
+	// SetupNeeded is the answer to CheckIDImmediate when the user has to
+	// interact with the OpenID Server, through CheckIDSetup. Nothing else is
+	// set then but the UserSetupURL given by OpenID 1.1 Servers.
+	SetupNeeded bool
+	// UserSetupURL is the OpenID 1.1 url to send the user to on SetupNeeded.
+	UserSetupURL string
+}
+
+// signedFields return the set of signed fields of values
+func signedFields(values map[string]string) map[string]bool {
+	signed := make(map[string]bool)
+	for _, k := range strings.Split(values["signed"], ",") {
+		if k != "" {
+			signed[k] = true
+		}
+	}
+	return signed
+}
+
+// unsignedKept are the values kept in the assertion though not signed
+var unsignedKept = map[string]bool{
+	"mode": true, "ns": true, "signed": true, "sig": true,
+}
+
+// dropUnsigned remove the values not signed from values, but mode, ns,
+// signed and sig, and return them. An unsigned value is never trusted,
+// whether it claims to belong to an extension or not.
+func dropUnsigned(values map[string]string) map[string]string {
+	signed := signedFields(values)
+	unsigned := make(map[string]string)
+
+	for k, v := range values {
+		if !signed[k] && !unsignedKept[k] {
+			unsigned[k] = v
+		}
+	}
+	for k := range unsigned {
+		delete(values, k)
+	}
+
+	return unsigned
+}
+
+// requiredSigned are the fields an OpenID 2.0 assertion has to sign, and
+// claimed_id and identity when present, OpenID 2.0 section 10.1
+var requiredSigned = []string{
+	"op_endpoint", "return_to", "response_nonce", "assoc_handle",
+}
+
+// checkRequiredSigned report an OpenID 2.0 assertion which leaves any of
+// requiredSigned out of its signed list
+func checkRequiredSigned(values map[string]string) error {
+	if isOpenID1(values) {
+		return nil
+	}
+
+	signed := signedFields(values)
+	for _, k := range requiredSigned {
+		if !signed[k] {
+			return fmt.Errorf("%w: %s", ErrFieldNotSigned, k)
+		}
+	}
+	for _, k := range []string{"claimed_id", "identity"} {
+		if _, ok := values[k]; ok && !signed[k] {
+			return fmt.Errorf("%w: %s", ErrFieldNotSigned, k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package openid
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// addUnsigned add unsigned openid values to the callback request r
+func addUnsigned(r *http.Request, values map[string]string) *http.Request {
+	q := r.URL.Query()
+	for k, v := range values {
+		q.Set("openid."+k, v)
+	}
+	r.URL.RawQuery = q.Encode()
+	return r
+}
+
+func Test_SetUnsignedExtensions(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	request := func() *http.Request {
+		r := idResRequest(t, assoc, map[string]string{
+			"ns.sreg":       NSSreg,
+			"sreg.nickname": "alice",
+		})
+		return addUnsigned(r, map[string]string{
+			"sreg.email": "alice@example.com",
+		})
+	}
+
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	assertion, err := o.IDResAssertion(request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := assertion.Values["sreg.email"]; ok {
+		t.Errorf("unsigned sreg.email should be dropped")
+	}
+	if assertion.Unsigned != nil {
+		t.Errorf("unsigned values surfaced by default: %v", assertion.Unsigned)
+	}
+	if got := assertion.Values["sreg.nickname"]; got != "alice" {
+		t.Errorf("signed sreg.nickname %q, want %q", got, "alice")
+	}
+
+	o.SetUnsignedExtensions(true)
+
+	assertion, err = o.IDResAssertion(request())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := assertion.Values["sreg.email"]; ok {
+		t.Errorf("unsigned sreg.email should not be in signed values")
+	}
+	if got := assertion.Unsigned["sreg.email"]; got != "alice@example.com" {
+		t.Errorf("unsigned sreg.email %q, want %q", got, "alice@example.com")
+	}
+}
+
+func Test_IDRes_UnsignedWithoutNamespace(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	// OpenID 1.1 sreg fields come without ns.sreg
+	r := addUnsigned(idResRequest(t, assoc, nil), map[string]string{
+		"sreg.email":  "mallory@example.com",
+		"ext0.value":  "mallory",
+		"unsigned_id": "https://example.com/mallory",
+	})
+
+	user, err := o.IDRes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"sreg.email", "ext0.value", "unsigned_id"} {
+		if _, ok := user[k]; ok {
+			t.Errorf("unsigned %s should be dropped", k)
+		}
+	}
+	for _, k := range []string{"mode", "ns", "signed", "sig", "claimed_id"} {
+		if _, ok := user[k]; !ok {
+			t.Errorf("%s should be kept", k)
+		}
+	}
+}
+
+func Test_IDResAssertion_Method(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	assertion, err := o.IDResAssertion(idResRequest(t, assoc, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertion.Method != VerifiedViaAssociation {
+		t.Errorf("Method %s, want %s", assertion.Method, VerifiedViaAssociation)
+	}
+}
+
+func Test_IDRes_RequiredSigned(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	r := idResRequest(t, assoc, map[string]string{
+		"ns.sreg":       NSSreg,
+		"sreg.nickname": "alice",
+	})
+	if _, err := o.IDRes(r); err != nil {
+		t.Fatalf("all fields signed: %v", err)
+	}
+
+	for _, field := range []string{
+		"op_endpoint", "return_to", "assoc_handle", "claimed_id", "identity",
+	} {
+		signed := idResRequest(t, assoc, nil)
+		r := addUnsigned(idResRequest(t, assoc, map[string]string{field: ""}),
+			map[string]string{field: signed.URL.Query().Get("openid." + field)})
+		if _, err := o.IDRes(r); !errors.Is(err, ErrFieldNotSigned) {
+			t.Errorf("unsigned %s: %v, want %v", field, err, ErrFieldNotSigned)
+		}
+	}
+}
@@ -7,17 +7,101 @@ import (
 	"encoding/base64"
 	"fmt"
 	"hash"
-	"log"
+	"math"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 const (
 	hmacSHA1   = "HMAC-SHA1"
 	hmacSHA256 = "HMAC-SHA256"
+
+	noEncryption = "no-encryption"
 )
 
+// AssocPreference is an association type, like HMAC-SHA256, with the session
+// type, like no-encryption, to request it with.
+type AssocPreference struct {
+	AssocType   string
+	SessionType string
+}
+
+// check report whether the association and session types are supported
+// together
+func (p AssocPreference) check() error {
+	switch p.AssocType {
+	case hmacSHA256, hmacSHA1:
+	default:
+		return fmt.Errorf("unsupported association type %q", p.AssocType)
+	}
+
+	switch {
+	case p.SessionType == noEncryption,
+		p.SessionType == dhSHA256 && p.AssocType == hmacSHA256,
+		p.SessionType == dhSHA1 && p.AssocType == hmacSHA1:
+	default:
+		return fmt.Errorf("unsupported session type %q for %s",
+			p.SessionType, p.AssocType)
+	}
+	return nil
+}
+
+// defaultAssocPreferences prefer the strongest association type, with a
+// Diffie-Hellman session first
+var defaultAssocPreferences = []AssocPreference{
+	{AssocType: hmacSHA256, SessionType: dhSHA256},
+	{AssocType: hmacSHA256, SessionType: noEncryption},
+	{AssocType: hmacSHA1, SessionType: dhSHA1},
+	{AssocType: hmacSHA1, SessionType: noEncryption},
+}
+
+// assocStrength ranks the association types, the stronger the higher
+var assocStrength = map[string]int{
+	hmacSHA1:   1,
+	hmacSHA256: 2,
+}
+
+// SetMinAssocType reject in IDRes the assertions signed with an association
+// type weaker than assocType, like HMAC-SHA1 for HMAC-SHA256, whether
+// verified with an association or directly. Empty allows all, the default.
+func (o *OpenID) SetMinAssocType(assocType string) error {
+	if _, ok := assocStrength[assocType]; !ok && assocType != "" {
+		return fmt.Errorf("unsupported association type %q", assocType)
+	}
+	o.minAssocType = assocType
+	return nil
+}
+
+// checkAssocType reject values signed with an association type weaker than
+// the minimum. The type is the one of assoc, or told by the signature length
+// for values verified directly.
+func (o *OpenID) checkAssocType(
+	assoc *Association, values map[string]string) error {
+
+	if o.minAssocType == "" {
+		return nil
+	}
+
+	var assocType string
+	if assoc != nil {
+		assocType = assoc.Type
+	} else if sig, err := base64.StdEncoding.DecodeString(values["sig"]); err == nil {
+		switch len(sig) {
+		case sha1.Size:
+			assocType = hmacSHA1
+		case sha256.Size:
+			assocType = hmacSHA256
+		}
+	}
+
+	if assocStrength[assocType] < assocStrength[o.minAssocType] {
+		return fmt.Errorf("%w: %q, want %s", ErrWeakAssoc, assocType,
+			o.minAssocType)
+	}
+	return nil
+}
+
 // Association represents an openid association.
 type Association struct {
 	// Endpoint is the OP Endpoint for which this association is valid.
@@ -31,11 +115,24 @@ type Association struct {
 	Type string
 	// Expires holds the expiration time of the association.
 	Expires time.Time
+	// Created holds the creation time of the association, it might be zero.
+	Created time.Time
 }
 
 func (a *Association) sign(
 	params map[string]string, signed []string) (string, error) {
 
+	mac, err := a.mac(params, signed)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(mac), nil
+}
+
+// mac compute the raw HMAC of the signed fields of params
+func (a *Association) mac(
+	params map[string]string, signed []string) ([]byte, error) {
+
 	var h hash.Hash
 
 	switch a.Type {
@@ -44,59 +141,108 @@ func (a *Association) sign(
 	case hmacSHA256:
 		h = hmac.New(sha256.New, a.Secret)
 	default:
-		return "", fmt.Errorf("unsupported association type %q", a.Type)
+		return nil, fmt.Errorf("unsupported association type %q", a.Type)
 	}
 
 	for _, k := range signed {
-		writeKeyValuePair(h, k, params[k])
+		if err := writeKeyValuePair(h, k, params[k]); err != nil {
+			return nil, err
+		}
 	}
 
-	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+	return h.Sum(nil), nil
 }
 
-// associations store association with key of OpenID endpoint
-type associations struct {
-	sync.Map
+// requestSignedFields are the checkid_setup fields signed by signRequest, in
+// order
+var requestSignedFields = []string{
+	"mode", "assoc_handle", "return_to", "realm", "trust_root",
+	"claimed_id", "identity",
 }
 
-// get Association with key of endpoint
-func (as *associations) get(endpoint string) (*Association, bool) {
-	endpoint = strings.TrimRight(endpoint, "/")
-	value, ok := as.Load(endpoint)
-	if !ok {
-		return nil, false
+// signRequest sign the requestSignedFields present in values with assoc,
+// setting the "signed" and "sig" fields
+func signRequest(assoc *Association, values map[string]string) error {
+	signed := make([]string, 0, len(requestSignedFields))
+	for _, k := range requestSignedFields {
+		if _, ok := values[k]; ok {
+			signed = append(signed, k)
+		}
 	}
 
-	assoc := value.(*Association)
-	if assoc.Expires.After(time.Now()) {
-		return assoc, ok
+	sig, err := assoc.sign(values, signed)
+	if err != nil {
+		return err
 	}
 
-	// Cleaning
-	from, to := as.gc()
-	log.Printf("associates GC from %d to %d", from, to)
-
-	return nil, false
+	values["signed"] = strings.Join(signed, ",")
+	values["sig"] = sig
+	return nil
 }
 
-// set Association with key of endpoint
-func (as *associations) set(endpoint string, a *Association) {
-	as.Store(strings.TrimRight(endpoint, "/"), a)
+// checkSecret reject association secrets of the wrong length or all-zero
+func checkSecret(assocType string, secret []byte) error {
+	var size int
+	switch assocType {
+	case hmacSHA1:
+		size = sha1.Size
+	case hmacSHA256:
+		size = sha256.Size
+	default:
+		return fmt.Errorf("unsupported association type %q", assocType)
+	}
+
+	if len(secret) != size {
+		return fmt.Errorf("%w: %d bytes secret for %s",
+			ErrWeakAssociationKey, len(secret), assocType)
+	}
+
+	for _, b := range secret {
+		if b != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: all-zero secret", ErrWeakAssociationKey)
 }
 
-// GC garbage collection
-func (as *associations) gc() (int, int) {
-	from, purged := 0, 0
+// parseExpiresIn parse the expires_in seconds of an association response,
+// tolerating surrounding whitespace and float values like "3600.0". Values
+// beyond 0..MaxInt32 fail.
+func parseExpiresIn(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
 
-	as.Map.Range(func(k, v interface{}) bool {
-		a := v.(*Association)
-		if a.Expires.Before(time.Now()) {
-			purged++
-			as.Map.Delete(k)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n < 0 || n > math.MaxInt32 {
+			return 0, fmt.Errorf("invalid expires_in %q", s)
 		}
-		from++
-		return true
-	})
+		return time.Duration(n) * time.Second, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid expires_in %q", s)
+	}
+	return time.Duration(f) * time.Second, nil
+}
+
+// VerifySignature verify the signature of an OpenID signed message. values
+// are the openid fields without the "openid." prefix, including "signed" and
+// "sig".
+func VerifySignature(assoc Association, values map[string]string) (bool, error) {
+	if values["signed"] == "" || values["sig"] == "" {
+		return false, fmt.Errorf("message is not signed")
+	}
+
+	mac, err := assoc.mac(values, strings.Split(values["signed"], ","))
+	if err != nil {
+		return false, err
+	}
+
+	// a malformed sig is only a mismatch
+	sig, err := base64.StdEncoding.DecodeString(values["sig"])
+	if err != nil {
+		return false, nil
+	}
 
-	return from, from - purged
+	return hmac.Equal(mac, sig), nil
 }
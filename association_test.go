@@ -0,0 +1,191 @@
+package openid
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_VerifySignature(t *testing.T) {
+	assoc := Association{
+		Handle:  "handle",
+		Secret:  []byte("secret"),
+		Type:    hmacSHA1,
+		Expires: time.Now().Add(time.Hour),
+	}
+
+	// HMAC-SHA1 of "mode:id_res\nclaimed_id:https://example.com/alice\n"
+	// with key "secret"
+	values := map[string]string{
+		"mode":       "id_res",
+		"claimed_id": "https://example.com/alice",
+		"signed":     "mode,claimed_id",
+		"sig":        "ctDcqISU1beczn17hmzv1zgsLGc=",
+	}
+
+	valid, err := VerifySignature(assoc, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Errorf("valid message not verified")
+	}
+
+	values["claimed_id"] = "https://example.com/mallory"
+	valid, err = VerifySignature(assoc, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Errorf("tampered message verified")
+	}
+
+	delete(values, "sig")
+	if _, err := VerifySignature(assoc, values); err == nil {
+		t.Errorf("unsigned message should fail")
+	}
+}
+
+func Test_parseExpiresIn(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"3600", time.Hour},
+		{"3600 ", time.Hour},
+		{" 3600\r", time.Hour},
+		{"3600.0", time.Hour},
+		{"3600.9", time.Hour},
+		{"0", 0},
+		{"2147483647", math.MaxInt32 * time.Second},
+	} {
+		got, err := parseExpiresIn(tc.in)
+		if err != nil {
+			t.Errorf("parseExpiresIn(%q): %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("parseExpiresIn(%q) %v, want %v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"", "soon", "-1.5", "1e300",
+		"-1", "2147483648", "99999999999999999999",
+	} {
+		if _, err := parseExpiresIn(in); err == nil {
+			t.Errorf("parseExpiresIn(%q) should fail", in)
+		}
+	}
+}
+
+func Test_checkSecret(t *testing.T) {
+	if err := checkSecret(hmacSHA256, fakeSecret); err != nil {
+		t.Errorf("valid secret: %v", err)
+	}
+	if err := checkSecret(hmacSHA1, fakeSecret); err == nil {
+		t.Errorf("32 bytes secret should fail for %s", hmacSHA1)
+	}
+	if err := checkSecret(hmacSHA1, make([]byte, 20)); err == nil {
+		t.Errorf("all-zero secret should fail")
+	}
+	if err := checkSecret("HMAC-MD5", fakeSecret); err == nil {
+		t.Errorf("unsupported association type should fail")
+	}
+}
+
+func Test_VerifySignature_NewlineInjection(t *testing.T) {
+	assoc := Association{Secret: []byte("secret"), Type: hmacSHA1}
+
+	// signing "mode:id_res\nclaimed_id:https://example.com/alice\n" as a
+	// single mode value must not pass for the two signed fields
+	values := map[string]string{
+		"mode":   "id_res\nclaimed_id:https://example.com/alice",
+		"signed": "mode",
+		"sig":    "ctDcqISU1beczn17hmzv1zgsLGc=",
+	}
+	if valid, err := VerifySignature(assoc, values); err == nil || valid {
+		t.Errorf("value with newline verified: %v, %v", valid, err)
+	}
+
+	values = map[string]string{
+		"mode:id_res\nclaimed_id": "https://example.com/alice",
+		"signed":                  "mode:id_res\nclaimed_id",
+		"sig":                     "ctDcqISU1beczn17hmzv1zgsLGc=",
+	}
+	if valid, err := VerifySignature(assoc, values); err == nil || valid {
+		t.Errorf("key with colon verified: %v, %v", valid, err)
+	}
+}
+
+func Test_VerifySignature_MalformedSig(t *testing.T) {
+	assoc := Association{
+		Handle:  "handle",
+		Secret:  []byte("secret"),
+		Type:    hmacSHA1,
+		Expires: time.Now().Add(time.Hour),
+	}
+
+	for _, sig := range []string{
+		"ctDcqISU1beczn17hmzv1zgsLA==", // valid base64, too short
+		"ctDcqISU1beczn17hmzv1zgsLGcAAAA=",
+		"ctDcqISU1beczn17hmzv1zgsLGc", // unpadded
+		"not base64!",
+	} {
+		values := map[string]string{
+			"mode":       "id_res",
+			"claimed_id": "https://example.com/alice",
+			"signed":     "mode,claimed_id",
+			"sig":        sig,
+		}
+
+		valid, err := VerifySignature(assoc, values)
+		if err != nil {
+			t.Errorf("sig %q: %v", sig, err)
+		}
+		if valid {
+			t.Errorf("sig %q verified", sig)
+		}
+	}
+}
+
+func Test_SetMinAssocType(t *testing.T) {
+	sha1Assoc := fakeAssociation("https://openidprovider.com/openid")
+	sha1Assoc.Type = hmacSHA1
+
+	o := New(realm)
+	o.assocs.Set(sha1Assoc.Endpoint, *sha1Assoc)
+	serveDiscovery(o, sha1Assoc.Endpoint)
+
+	if _, err := o.IDRes(idResRequest(t, sha1Assoc, nil)); err != nil {
+		t.Errorf("HMAC-SHA1 allowed by default: %v", err)
+	}
+
+	if err := o.SetMinAssocType(hmacSHA256); err != nil {
+		t.Fatal(err)
+	}
+	_, err := o.IDRes(idResRequest(t, sha1Assoc, nil))
+	if !errors.Is(err, ErrWeakAssoc) {
+		t.Errorf("HMAC-SHA1 association: %v, want %v", err, ErrWeakAssoc)
+	}
+
+	// verified directly, told by the signature length
+	for assocType, want := range map[string]error{
+		hmacSHA1:   ErrWeakAssoc,
+		hmacSHA256: nil,
+	} {
+		ts := newCheckAuthProvider(t, true, "")
+		a := fakeAssociation(ts.URL)
+		a.Type = assocType
+		serveDiscovery(o, ts.URL)
+		logInWith(o, ts.URL)
+
+		_, err := o.IDRes(idResRequest(t, a, nil))
+		if !errors.Is(err, want) {
+			t.Errorf("%s verified directly: %v, want %v", assocType, err, want)
+		}
+	}
+
+	if err := o.SetMinAssocType("HMAC-MD5"); err == nil {
+		t.Errorf("unsupported association type should fail")
+	}
+}
@@ -0,0 +1,260 @@
+package openid
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// axAlias return the alias of the AX extension declared in values
+func axAlias(values map[string]string) (string, bool) {
+	if values["ns.ax"] == NSAX {
+		return "ax", true
+	}
+	for k, v := range values {
+		if v == NSAX && strings.HasPrefix(k, "ns.") {
+			return strings.TrimPrefix(k, "ns."), true
+		}
+	}
+	return "", false
+}
+
+// parseAX get the AX attribute values from values, keyed by attribute alias.
+// Multi-valued attributes announced by "ax.count.<alias>" keep all their
+// "ax.value.<alias>.<n>" values in order.
+func parseAX(values map[string]string) (map[string][]string, error) {
+	ax, ok := axAlias(values)
+	if !ok {
+		return nil, nil
+	}
+
+	typePrefix := ax + ".type."
+	attrs := make(map[string][]string)
+
+	for k := range values {
+		if !strings.HasPrefix(k, typePrefix) {
+			continue
+		}
+		alias := strings.TrimPrefix(k, typePrefix)
+
+		count, ok := values[ax+".count."+alias]
+		if !ok {
+			if v, ok := values[ax+".value."+alias]; ok {
+				attrs[alias] = []string{v}
+			}
+			continue
+		}
+
+		// there cannot be more values than the fields of the assertion, a
+		// larger count would only allocate for missing ones
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 0 || n > len(values) {
+			return nil, fmt.Errorf("invalid %s.count.%s %q", ax, alias, count)
+		}
+
+		attr := make([]string, 0, n)
+		for i := 1; i <= n; i++ {
+			v, ok := values[fmt.Sprintf("%s.value.%s.%d", ax, alias, i)]
+			if !ok {
+				return nil, fmt.Errorf("missing %s.value.%s.%d", ax, alias, i)
+			}
+			attr = append(attr, v)
+		}
+		attrs[alias] = attr
+	}
+
+	return attrs, nil
+}
+
+// axValue get the first AX value of typeURI in user, whatever alias the
+// OpenID Server used. ax holds the parsed AX values.
+func axValue(user map[string]string,
+	ax map[string][]string, typeURI string) (string, bool) {
+
+	alias, ok := axAlias(user)
+	if !ok {
+		return "", false
+	}
+	for k, v := range user {
+		if v == typeURI && strings.HasPrefix(k, alias+".type.") {
+			values := ax[strings.TrimPrefix(k, alias+".type.")]
+			if len(values) > 0 {
+				return values[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+// axFriendlyNames are the friendly names of well-known AX attribute types
+var axFriendlyNames = map[string]string{
+	axTypeEmail:                                "email",
+	"http://axschema.org/namePerson":           "fullname",
+	"http://axschema.org/namePerson/first":     "firstname",
+	"http://axschema.org/namePerson/last":      "lastname",
+	"http://axschema.org/namePerson/friendly":  "nickname",
+	"http://axschema.org/pref/language":        "language",
+	"http://axschema.org/pref/timezone":        "timezone",
+	"http://axschema.org/contact/country/home": "country",
+}
+
+// axAttribute is an AX attribute requested by CheckIDSetup
+type axAttribute struct {
+	// alias is the alias of the attribute in the request, and its friendly
+	// name in the user values.
+	alias string
+	// typeURI is the attribute type, like http://axschema.org/contact/email.
+	typeURI string
+	// required is whether the attribute is required or if_available.
+	required bool
+}
+
+// defaultMaxAXAttributes is how many AX attributes might be requested by
+// default, more bloat the checkid_setup url and some OpenID Servers cap them
+const defaultMaxAXAttributes = 32
+
+// AXLimitPolicy is what SetAXAttributes does with the attributes beyond the
+// limit set by SetMaxAXAttributes.
+type AXLimitPolicy int
+
+const (
+	// AXLimitError fails SetAXAttributes, the default.
+	AXLimitError AXLimitPolicy = iota
+	// AXLimitTruncate requests the first attributes only, the required ones
+	// first, logging a warning.
+	AXLimitTruncate
+)
+
+// SetMaxAXAttributes limit the AX attributes SetAXAttributes requests to n,
+// 32 by default, zero for no limit. Attributes already set beyond the limit
+// are truncated with AXLimitTruncate, or fail CheckIDSetup with
+// AXLimitError.
+func (o *OpenID) SetMaxAXAttributes(n int, policy AXLimitPolicy) {
+	o.maxAXAttributes = n
+	o.axLimitPolicy = policy
+
+	if policy == AXLimitTruncate {
+		o.axAttributes, _ = o.limitAX(o.axAttributes)
+	}
+}
+
+// limitAX apply the SetMaxAXAttributes limit and policy to attrs
+func (o *OpenID) limitAX(attrs []axAttribute) ([]axAttribute, error) {
+	limit := o.maxAXAttributes
+	if limit <= 0 || len(attrs) <= limit {
+		return attrs, nil
+	}
+
+	if o.axLimitPolicy != AXLimitTruncate {
+		return nil, fmt.Errorf("%d AX attributes exceed the limit of %d",
+			len(attrs), limit)
+	}
+	log.Printf("%d AX attributes truncated to the limit of %d",
+		len(attrs), limit)
+	return attrs[:limit], nil
+}
+
+// SetAXAttributes request AX attributes by type URI, like
+// http://axschema.org/contact/email, in CheckIDSetup along with SReg. The
+// returned values are set in the user values under "ax.<name>", with the
+// friendly name of well-known types, like "ax.email", or "ax.attr<n>".
+// More attributes than the SetMaxAXAttributes limit fail or are truncated.
+func (o *OpenID) SetAXAttributes(required, optional []string) error {
+	attrs := make([]axAttribute, 0, len(required)+len(optional))
+	seen := make(map[string]bool)
+
+	add := func(typeURI string, required bool) error {
+		u, err := url.Parse(typeURI)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid AX type URI %q", typeURI)
+		}
+		if seen[typeURI] {
+			return nil
+		}
+		seen[typeURI] = true
+
+		alias, ok := axFriendlyNames[typeURI]
+		if !ok {
+			alias = fmt.Sprintf("attr%d", len(attrs))
+		}
+		attrs = append(attrs, axAttribute{alias, typeURI, required})
+		return nil
+	}
+
+	for _, typeURI := range required {
+		if err := add(typeURI, true); err != nil {
+			return err
+		}
+	}
+	for _, typeURI := range optional {
+		if err := add(typeURI, false); err != nil {
+			return err
+		}
+	}
+
+	attrs, err := o.limitAX(attrs)
+	if err != nil {
+		return err
+	}
+
+	o.axAttributes = attrs
+	return nil
+}
+
+// axRequest add the AX fetch_request of the requested attributes to values,
+// failing when they exceed the SetMaxAXAttributes limit
+func (o *OpenID) axRequest(values map[string]string) error {
+	if len(o.axAttributes) == 0 {
+		return nil
+	}
+	if _, err := o.limitAX(o.axAttributes); err != nil {
+		return err
+	}
+
+	var required, optional []string
+	for _, attr := range o.axAttributes {
+		values["ax.type."+attr.alias] = attr.typeURI
+		if attr.required {
+			required = append(required, attr.alias)
+		} else {
+			optional = append(optional, attr.alias)
+		}
+	}
+
+	values["ns.ax"] = NSAX
+	values["ax.mode"] = "fetch_request"
+	if len(required) > 0 {
+		values["ax.required"] = strings.Join(required, ",")
+	}
+	if len(optional) > 0 {
+		values["ax.if_available"] = strings.Join(optional, ",")
+	}
+	return nil
+}
+
+// axFriendly set the values of the requested AX attributes in user under
+// "ax.<name>", whatever alias the OpenID Server used. ax holds the parsed
+// AX values.
+func (o *OpenID) axFriendly(user map[string]string, ax map[string][]string) {
+	alias, ok := axAlias(user)
+	if !ok || len(o.axAttributes) == 0 {
+		return
+	}
+
+	// the type of each attribute alias of the OpenID Server
+	types := make(map[string]string)
+	for k, v := range user {
+		if strings.HasPrefix(k, alias+".type.") {
+			types[v] = strings.TrimPrefix(k, alias+".type.")
+		}
+	}
+
+	for _, attr := range o.axAttributes {
+		values, ok := ax[types[attr.typeURI]]
+		if ok && len(values) > 0 {
+			user["ax."+attr.alias] = values[0]
+		}
+	}
+}
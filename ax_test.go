@@ -0,0 +1,232 @@
+package openid
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_IDRes_AXMultiValued(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	r := idResRequest(t, assoc, map[string]string{
+		"ns.ax":            NSAX,
+		"ax.mode":          "fetch_response",
+		"ax.type.email":    "http://axschema.org/contact/email",
+		"ax.count.email":   "2",
+		"ax.value.email.1": "alice@example.com",
+		"ax.value.email.2": "alice@example.org",
+		"ax.type.nick":     "http://axschema.org/namePerson/friendly",
+		"ax.value.nick":    "alice",
+	})
+
+	assertion, err := o.IDResAssertion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"email": {"alice@example.com", "alice@example.org"},
+		"nick":  {"alice"},
+	}
+	if !reflect.DeepEqual(assertion.AX, want) {
+		t.Errorf("AX %v, want %v", assertion.AX, want)
+	}
+}
+
+func Test_parseAX_MissingValue(t *testing.T) {
+	_, err := parseAX(map[string]string{
+		"ns.ax":            NSAX,
+		"ax.type.email":    "http://axschema.org/contact/email",
+		"ax.count.email":   "2",
+		"ax.value.email.1": "alice@example.com",
+	})
+	if err == nil {
+		t.Errorf("missing counted value should fail")
+	}
+}
+
+func Test_parseAX_HugeCount(t *testing.T) {
+	for _, count := range []string{"3", "1000000000", "9223372036854775807"} {
+		_, err := parseAX(map[string]string{
+			"ns.ax":            NSAX,
+			"ax.type.email":    "http://axschema.org/contact/email",
+			"ax.count.email":   count,
+			"ax.value.email.1": "alice@example.com",
+		})
+		if err == nil {
+			t.Errorf("count %s larger than the values should fail", count)
+		}
+	}
+}
+
+func Test_SetAXAttributes(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	unknown := "http://example.com/schema/team"
+	err := o.SetAXAttributes(
+		[]string{axTypeEmail, "http://axschema.org/namePerson"},
+		[]string{unknown, axTypeEmail})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	for k, want := range map[string]string{
+		"openid.ns.ax":            NSAX,
+		"openid.ax.mode":          "fetch_request",
+		"openid.ax.required":      "email,fullname",
+		"openid.ax.if_available":  "attr2",
+		"openid.ax.type.email":    axTypeEmail,
+		"openid.ax.type.fullname": "http://axschema.org/namePerson",
+		"openid.ax.type.attr2":    unknown,
+		"openid.ns.sreg":          NSSreg,
+	} {
+		if got := q.Get(k); got != want {
+			t.Errorf("%s %q, want %q", k, got, want)
+		}
+	}
+
+	// the OpenID Server answers with its own aliases
+	user, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL),
+		map[string]string{
+			"ns.ext1":         NSAX,
+			"ext1.mode":       "fetch_response",
+			"ext1.type.mail":  axTypeEmail,
+			"ext1.value.mail": "alice@example.com",
+			"ext1.type.t":     unknown,
+			"ext1.value.t":    "wonderland",
+			"ns.sreg":         NSSreg,
+			"sreg.nickname":   "alice",
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range map[string]string{
+		"ax.email":      "alice@example.com",
+		"ax.attr2":      "wonderland",
+		"sreg.nickname": "alice",
+	} {
+		if got := user[k]; got != want {
+			t.Errorf("%s %q, want %q", k, got, want)
+		}
+	}
+	if _, ok := user["ax.fullname"]; ok {
+		t.Errorf("ax.fullname was not returned")
+	}
+
+	if err := o.SetAXAttributes([]string{"email"}, nil); err == nil {
+		t.Errorf("relative type URI should fail")
+	}
+}
+
+func Test_SetMaxAXAttributes(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	types := func(n int) []string {
+		uris := make([]string, n)
+		for i := range uris {
+			uris[i] = fmt.Sprintf("http://example.com/schema/%d", i)
+		}
+		return uris
+	}
+
+	o := New(realm)
+	if err := o.SetAXAttributes(types(defaultMaxAXAttributes), nil); err != nil {
+		t.Errorf("attributes up to the default limit: %v", err)
+	}
+	if err := o.SetAXAttributes(types(defaultMaxAXAttributes+1), nil); err == nil {
+		t.Errorf("attributes beyond the default limit should fail")
+	}
+
+	o.SetMaxAXAttributes(2, AXLimitError)
+	if err := o.SetAXAttributes(types(3), nil); err == nil {
+		t.Errorf("attributes beyond the limit should fail")
+	}
+	if len(o.axAttributes) != defaultMaxAXAttributes {
+		t.Errorf("failed SetAXAttributes changed the attributes")
+	}
+
+	o.SetMaxAXAttributes(2, AXLimitTruncate)
+	if err := o.SetAXAttributes([]string{axTypeEmail}, types(3)); err != nil {
+		t.Fatal(err)
+	}
+	want := []axAttribute{
+		{"email", axTypeEmail, true},
+		{"attr1", "http://example.com/schema/0", false},
+	}
+	if !reflect.DeepEqual(o.axAttributes, want) {
+		t.Errorf("truncated attributes %v, want %v", o.axAttributes, want)
+	}
+	if !strings.Contains(logs.String(), "truncated") {
+		t.Errorf("no warning logged: %q", logs.String())
+	}
+
+	o.SetMaxAXAttributes(0, AXLimitError)
+	if err := o.SetAXAttributes(types(100), nil); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+}
+
+func Test_SetMaxAXAttributes_AfterSet(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ts := newFakeProvider(t)
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	required := []string{axTypeEmail, "http://axschema.org/namePerson"}
+	if err := o.SetAXAttributes(required, []string{"http://example.com/schema/0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a limit lowered after the attributes were set still applies
+	o.SetMaxAXAttributes(2, AXLimitError)
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err == nil {
+		t.Errorf("attributes beyond the limit should fail CheckIDSetup")
+	}
+
+	o.SetMaxAXAttributes(2, AXLimitTruncate)
+	urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if got := q.Get("openid.ax.required"); got != "email,fullname" {
+		t.Errorf("ax.required %q, want the first two attributes", got)
+	}
+	if q.Has("openid.ax.if_available") {
+		t.Errorf("truncated attribute requested: %v", q)
+	}
+	if !strings.Contains(logs.String(), "truncated") {
+		t.Errorf("no warning logged: %q", logs.String())
+	}
+}
@@ -0,0 +1,90 @@
+package openid
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a string keyed cache safe for concurrent use, which forgets
+// the least recently used entries beyond its size
+type lruCache struct {
+	mu   sync.Mutex
+	size int
+	// order holds the *lruEntry, the most recently used first.
+	order *list.List
+	items map[string]*list.Element
+}
+
+// lruEntry is a value of an lruCache
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRUCache return an lruCache of at most size entries
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// get the value of key
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// add set the value of key
+func (c *lruCache) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.push(key, value)
+}
+
+// getOrAdd return the value of key, or set it to value when absent and
+// report it was not loaded
+func (c *lruCache) getOrAdd(key string, value interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	c.push(key, value)
+	return value, false
+}
+
+// push add the absent key, evicting the least recently used entries
+// beyond the size. c.mu is held.
+func (c *lruCache) push(key string, value interface{}) {
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		delete(c.items, e.Value.(*lruEntry).key)
+		c.order.Remove(e)
+	}
+}
+
+// len return the number of entries
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
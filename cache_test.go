@@ -0,0 +1,32 @@
+package openid
+
+import "testing"
+
+func Test_lruCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", 1)
+	c.add("b", 2)
+
+	// a is used more recently than b
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf("get(a) %v, %v, want 1, true", v, ok)
+	}
+	c.add("c", 3)
+
+	if _, ok := c.get("b"); ok {
+		t.Errorf("least recently used entry not evicted")
+	}
+	if c.len() != 2 {
+		t.Errorf("len %d, want 2", c.len())
+	}
+
+	if v, loaded := c.getOrAdd("c", 4); !loaded || v != 3 {
+		t.Errorf("getOrAdd(c) %v, %v, want 3, true", v, loaded)
+	}
+	if v, loaded := c.getOrAdd("d", 4); loaded || v != 4 {
+		t.Errorf("getOrAdd(d) %v, %v, want 4, false", v, loaded)
+	}
+	if _, ok := c.get("a"); ok {
+		t.Errorf("least recently used entry not evicted by getOrAdd")
+	}
+}
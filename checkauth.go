@@ -0,0 +1,106 @@
+package openid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// knownEndpointsSize is how many endpoints logged in with are remembered to
+// verify their assertions directly
+const knownEndpointsSize = 10000
+
+// checkAuthentication ask the OpenID Server endpoint to verify the signature
+// of the assertion values directly, for assertions which are not signed with
+// a known association. Only known endpoints are asked, so an assertion
+// cannot name any url to verify itself.
+func (o *OpenID) checkAuthentication(ctx context.Context,
+	endpoint string, values map[string]string) (err error) {
+
+	if !o.endpointKnown(endpoint) {
+		return fmt.Errorf("%w: %s", ErrEndpointUnknown, endpoint)
+	}
+
+	start := time.Now()
+	defer func() { o.observe(PhaseCheckAuthentication, endpoint, start, err) }()
+
+	client, err := o.httpClient(endpoint)
+	if err != nil {
+		return err
+	}
+
+	params := make(map[string]string, len(values))
+	for k, v := range values {
+		params[k] = v
+	}
+	params["mode"] = "check_authentication"
+
+	form := url.Values{}
+	encodeHTTP(form, params)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return responseError(resp, o.checkAuthenticationResponse(endpoint, resp))
+}
+
+// checkAuthenticationResponse check the check_authentication response resp
+// confirms the signature
+func (o *OpenID) checkAuthenticationResponse(
+	endpoint string, resp *http.Response) error {
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	openidValues, err := parseKeyValue(body)
+	if err != nil {
+		return fmt.Errorf("%w: %s answered %q: %v",
+			ErrDirectVerifyFailed, endpoint, rawResponse(body), err)
+	}
+
+	if openidValues["error"] != "" {
+		return &directError{values: openidValues}
+	}
+
+	// the OpenID Server no longer knows the handle we sent with checkid
+	if handle := openidValues["invalidate_handle"]; handle != "" {
+		if assoc, ok := o.assocs.Get(endpoint); ok && assoc.Handle == handle {
+			o.assocs.Delete(endpoint)
+		}
+	}
+
+	// anything but a clear is_valid:true fails, like a missing is_valid
+	if openidValues["is_valid"] != "true" {
+		return fmt.Errorf("%w: %s answered is_valid %q, response %q",
+			ErrDirectVerifyFailed, endpoint, openidValues["is_valid"],
+			rawResponse(body))
+	}
+	return nil
+}
+
+// maxRawResponse limits the response quoted in errors
+const maxRawResponse = 512
+
+// rawResponse return the start of the response body for errors
+func rawResponse(body []byte) string {
+	if len(body) > maxRawResponse {
+		return string(body[:maxRawResponse]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,229 @@
+package openid
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCheckAuthProvider return an OpenID Server answering check_authentication
+// with isValid, and invalidating the handle invalidate if not empty
+func newCheckAuthProvider(
+	t *testing.T, isValid bool, invalidate string) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("check_authentication method %s, want POST", r.Method)
+			}
+			if mode := r.PostFormValue("openid.mode"); mode != "check_authentication" {
+				t.Errorf("openid.mode %q, want check_authentication", mode)
+			}
+
+			fmt.Fprintf(w, "ns:%s\n", Namespace)
+			fmt.Fprintf(w, "is_valid:%t\n", isValid)
+			if invalidate != "" {
+				fmt.Fprintf(w, "invalidate_handle:%s\n", invalidate)
+			}
+		}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// logInWith make endpoint known to o, as a login with it does
+func logInWith(o *OpenID, endpoint string) {
+	o.endpoints.add(endpoint, struct{}{})
+}
+
+func Test_IDRes_CheckAuthentication(t *testing.T) {
+	ts := newCheckAuthProvider(t, true, "")
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+	logInWith(o, ts.URL)
+
+	var phases []Phase
+	o.SetObserver(ObserverFunc(
+		func(phase Phase, endpoint string, d time.Duration, err error) {
+			phases = append(phases, phase)
+		}))
+
+	// signed with a private association of the OpenID Server
+	r := idResRequest(t, fakeAssociation(ts.URL), nil)
+	a, err := o.IDResAssertion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Method != VerifiedViaDirect {
+		t.Errorf("method %v, want %v", a.Method, VerifiedViaDirect)
+	}
+	if a.Values["claimed_id"] != "https://openidprovider.com/id/alice" {
+		t.Errorf("claimed_id %q", a.Values["claimed_id"])
+	}
+
+	want := []Phase{PhaseCheckAuthentication, PhaseVerify}
+	if !reflect.DeepEqual(phases, want) {
+		t.Errorf("phases %v, want %v", phases, want)
+	}
+}
+
+func Test_IDRes_CheckAuthenticationInvalid(t *testing.T) {
+	ts := newCheckAuthProvider(t, false, "")
+	o := New(realm)
+	logInWith(o, ts.URL)
+
+	r := idResRequest(t, fakeAssociation(ts.URL), nil)
+	if _, err := o.IDRes(r); !errors.Is(err, ErrDirectVerifyFailed) {
+		t.Errorf("is_valid:false %v, want %v", err, ErrDirectVerifyFailed)
+	}
+}
+
+func Test_IDRes_CheckAuthenticationMalformed(t *testing.T) {
+	for _, body := range []string{
+		"is_valid:yes\n",
+		"is_valid:TRUE\n",
+		"ns:" + Namespace + "\n",
+		"<html>maintenance</html>",
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}))
+		o := New(realm)
+		logInWith(o, ts.URL)
+
+		_, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL), nil))
+		if !errors.Is(err, ErrDirectVerifyFailed) {
+			t.Errorf("response %q: %v, want %v", body, err, ErrDirectVerifyFailed)
+		} else if !strings.Contains(err.Error(), fmt.Sprintf("%q", body)) {
+			t.Errorf("error %q does not quote the response %q", err, body)
+		}
+		ts.Close()
+	}
+}
+
+func Test_IDRes_InvalidateHandle(t *testing.T) {
+	ts := newCheckAuthProvider(t, true, "stale-handle")
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	stale := fakeAssociation(ts.URL)
+	stale.Handle = "stale-handle"
+	o.assocs.Set(ts.URL, *stale)
+
+	// the OpenID Server signed with a fresh handle
+	r := idResRequest(t, fakeAssociation(ts.URL), nil)
+	if _, err := o.IDRes(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := o.association(ts.URL, 0); ok {
+		t.Errorf("invalidated association should be deleted")
+	}
+}
+
+func Test_IDRes_AssertionInvalidateHandle(t *testing.T) {
+	ts := newCheckAuthProvider(t, true, "")
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	stale := fakeAssociation(ts.URL)
+	stale.Handle = "stale-handle"
+	o.assocs.Set(ts.URL, *stale)
+
+	// the OpenID Server signed with a fresh handle, naming the one we sent
+	fresh := fakeAssociation(ts.URL)
+	fresh.Handle = "fresh-handle"
+	r := idResRequest(t, fresh,
+		map[string]string{"invalidate_handle": "stale-handle"})
+
+	a, err := o.IDResAssertion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Method != VerifiedViaDirect {
+		t.Errorf("method %v, want %v", a.Method, VerifiedViaDirect)
+	}
+	if _, ok := o.assocs.Get(ts.URL); ok {
+		t.Errorf("invalidated association should be deleted")
+	}
+}
+
+func Test_IDRes_RotatedSecret(t *testing.T) {
+	for _, isValid := range []bool{true, false} {
+		ts := newCheckAuthProvider(t, isValid, "")
+		o := New(realm)
+		serveDiscovery(o, ts.URL)
+
+		stale := fakeAssociation(ts.URL)
+		stale.Secret = make([]byte, len(fakeSecret))
+		copy(stale.Secret, fakeSecret)
+		stale.Secret[0] ^= 0xff
+		o.assocs.Set(ts.URL, *stale)
+
+		// the OpenID Server signed with a new secret for the same handle
+		a, err := o.IDResAssertion(idResRequest(t, fakeAssociation(ts.URL), nil))
+		if !isValid {
+			if !errors.Is(err, ErrDirectVerifyFailed) {
+				t.Errorf("unconfirmed assertion error %v, want %v",
+					err, ErrDirectVerifyFailed)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Method != VerifiedViaDirect {
+			t.Errorf("method %v, want %v", a.Method, VerifiedViaDirect)
+		}
+		if _, ok := o.assocs.Get(ts.URL); ok {
+			t.Errorf("stale association should be deleted")
+		}
+	}
+}
+
+func Test_IDRes_CheckAuthenticationUnknownEndpoint(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			fmt.Fprintf(w, "ns:%s\nis_valid:true\n", Namespace)
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	// an assertion naming any url to verify itself
+	_, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL), nil))
+	if !errors.Is(err, ErrEndpointUnknown) {
+		t.Errorf("unknown endpoint: %v, want %v", err, ErrEndpointUnknown)
+	}
+	if requests != 0 {
+		t.Errorf("%d requests to the unknown endpoint, want 0", requests)
+	}
+
+	// known by a stateless login
+	o.SetStateless(true)
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL), nil)); err != nil {
+		t.Errorf("endpoint logged in with: %v", err)
+	}
+
+	// known by the allowed endpoints, shared by several instances
+	o = New(realm)
+	serveDiscovery(o, ts.URL)
+	o.SetAllowedEndpoints(ts.URL + "/")
+	if _, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL), nil)); err != nil {
+		t.Errorf("allowed endpoint: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package openid
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetHTTPClient set the http.Client making the requests to OpenID Servers,
+// like one with timeouts, a proxy or a custom transport. http.DefaultClient
+// is used by default, or when client is nil.
+func (o *OpenID) SetHTTPClient(client *http.Client) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	o.client = client
+}
+
+// SetPinnedCertificates pin the TLS certificates of endpoint. pins are the
+// base64 encoded SHA-256 hashes of the certificate SubjectPublicKeyInfo,
+// requests to endpoint fail unless its certificate matches one of them.
+func (o *OpenID) SetPinnedCertificates(endpoint string, pins ...string) {
+	if o.pins == nil {
+		o.pins = make(map[string][]string)
+	}
+	o.pins[strings.TrimRight(endpoint, "/")] = pins
+}
+
+// SPKIHash return the base64 encoded SHA-256 hash of the certificate
+// SubjectPublicKeyInfo, as used by SetPinnedCertificates.
+func SPKIHash(rawSubjectPublicKeyInfo []byte) string {
+	sum := sha256.Sum256(rawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SetStrictHostname check the TLS certificate of each endpoint is valid for
+// the endpoint host, even when the http.Client TLS config skips or changes
+// the default verification, like with a custom ServerName.
+func (o *OpenID) SetStrictHostname(strict bool) {
+	o.strictHostname = strict
+}
+
+// httpClient return the http.Client for requests to endpoint
+func (o *OpenID) httpClient(endpoint string) (*http.Client, error) {
+	pins := o.pins[strings.TrimRight(endpoint, "/")]
+	if len(pins) == 0 && !o.strictHostname {
+		return o.client, nil
+	}
+
+	if !strings.HasPrefix(endpoint, "https://") {
+		if len(pins) == 0 {
+			return nil, fmt.Errorf("%w: %s is not https",
+				ErrCertificateHostMismatch, endpoint)
+		}
+		return nil, fmt.Errorf("%w: %s is not https", ErrCertificatePinMismatch,
+			endpoint)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+
+	base := o.client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf(
+			"certificate verification requires an *http.Transport, got %T", base)
+	}
+
+	// connections are never reused by this single use transport
+	transport = transport.Clone()
+	transport.DisableKeepAlives = true
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	verify := transport.TLSClientConfig.VerifyConnection
+	strict := o.strictHostname
+	transport.TLSClientConfig.VerifyConnection = func(
+		cs tls.ConnectionState) error {
+
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		if strict {
+			if err := verifyHostname(cs, host); err != nil {
+				return err
+			}
+		}
+		if len(pins) > 0 {
+			return verifyPins(cs, pins)
+		}
+		return nil
+	}
+
+	client := *o.client
+	client.Transport = transport
+	return &client, nil
+}
+
+// verifyHostname check the peer certificate of cs is valid for host
+func verifyHostname(cs tls.ConnectionState, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no peer certificate", ErrCertificateHostMismatch)
+	}
+	if err := cs.PeerCertificates[0].VerifyHostname(host); err != nil {
+		return fmt.Errorf("%w: %v", ErrCertificateHostMismatch, err)
+	}
+	return nil
+}
+
+// verifyPins check the peer certificate of cs against pins
+func verifyPins(cs tls.ConnectionState, pins []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no peer certificate", ErrCertificatePinMismatch)
+	}
+
+	hash := SPKIHash(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if pin == hash {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s has certificate %s", ErrCertificatePinMismatch,
+		cs.ServerName, hash)
+}
@@ -0,0 +1,106 @@
+package openid
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_SetPinnedCertificates(t *testing.T) {
+	ts := httptest.NewTLSServer(fakeProvider)
+	defer ts.Close()
+
+	pin := SPKIHash(ts.Certificate().RawSubjectPublicKeyInfo)
+
+	o := New(realm)
+	o.client = ts.Client()
+	o.SetPinnedCertificates(ts.URL, pin)
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+
+	o = New(realm)
+	o.client = ts.Client()
+	o.SetPinnedCertificates(ts.URL, SPKIHash([]byte("another key")))
+
+	_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if !errors.Is(err, ErrCertificatePinMismatch) {
+		t.Errorf("mismatching pin error %v, want %v",
+			err, ErrCertificatePinMismatch)
+	}
+}
+
+func Test_SetStrictHostname(t *testing.T) {
+	ts := httptest.NewTLSServer(fakeProvider)
+	defer ts.Close()
+
+	// the test certificate is valid for 127.0.0.1, not for localhost
+	endpoint := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	// a custom TLS config skipping the default verification
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	client.Transport = transport
+
+	o := New(realm)
+	o.client = client
+	if _, err := o.CheckIDSetup(endpoint, callbackPrefix); err != nil {
+		t.Fatalf("without strict hostname: %v", err)
+	}
+
+	o = New(realm)
+	o.client = client
+	o.SetStrictHostname(true)
+
+	_, err := o.CheckIDSetup(endpoint, callbackPrefix)
+	if !errors.Is(err, ErrCertificateHostMismatch) {
+		t.Errorf("mismatching hostname error %v, want %v",
+			err, ErrCertificateHostMismatch)
+	}
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Errorf("matching hostname: %v", err)
+	}
+}
+
+// roundTripFunc adapts a function to an http.RoundTripper
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+// RoundTrip call f(r)
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func Test_SetHTTPClient(t *testing.T) {
+	endpoint := "https://openidprovider.com/openid"
+
+	// serve the fake OpenID Server without any listener
+	var requests int
+	o := New(realm)
+	o.SetHTTPClient(&http.Client{Transport: roundTripFunc(
+		func(r *http.Request) (*http.Response, error) {
+			requests++
+			rw := httptest.NewRecorder()
+			fakeProvider.ServeHTTP(rw, r)
+			return rw.Result(), nil
+		})})
+
+	if _, err := o.CheckIDSetup(endpoint, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("%d requests through the client, want 1", requests)
+	}
+	if _, ok := o.association(endpoint, 0); !ok {
+		t.Errorf("association not stored")
+	}
+
+	o.SetHTTPClient(nil)
+	if o.client != http.DefaultClient {
+		t.Errorf("nil client should reset to http.DefaultClient")
+	}
+}
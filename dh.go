@@ -0,0 +1,118 @@
+package openid
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+const (
+	dhSHA1   = "DH-SHA1"
+	dhSHA256 = "DH-SHA256"
+)
+
+// dhModulus is the default Diffie-Hellman modulus of OpenID 2.0
+var dhModulus, _ = new(big.Int).SetString(
+	"DCF93A0B883972EC0E19989AC5A2CE310E1D37717E8D9571BB7623731866E61E"+
+		"F75A2E27898B057F9891C2E27A639C3F29B60814581CD3B2CA3986D268370557"+
+		"7D45C2E7E52DC81C7A171876E5CEA74B1448BFDFAF18828EFD2519F14E45E382"+
+		"6634AF1949E5B535CC829A483B8A76223E5D490A257F05BDFF16F2FB22C583AB", 16)
+
+// dhGen is the default Diffie-Hellman generator of OpenID 2.0
+var dhGen = big.NewInt(2)
+
+// dhSession is the Consumer side of a Diffie-Hellman association session
+type dhSession struct {
+	sessionType string
+	private     *big.Int
+	public      *big.Int
+}
+
+// newDHSession generate the Diffie-Hellman key pair of the Consumer
+func (o *OpenID) newDHSession(sessionType string) (*dhSession, error) {
+	if _, err := dhHash(sessionType); err != nil {
+		return nil, err
+	}
+
+	// private key in [1, p-1)
+	b, err := o.randomBytes(len(dhModulus.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	n := new(big.Int).Sub(dhModulus, big.NewInt(2))
+	private := new(big.Int).Mod(new(big.Int).SetBytes(b), n)
+	private.Add(private, big.NewInt(1))
+
+	return &dhSession{
+		sessionType: sessionType,
+		private:     private,
+		public:      new(big.Int).Exp(dhGen, private, dhModulus),
+	}, nil
+}
+
+// values return the openid values of the associate request
+func (s *dhSession) values() map[string]string {
+	return map[string]string{
+		"dh_modulus":         base64.StdEncoding.EncodeToString(btwoc(dhModulus)),
+		"dh_gen":             base64.StdEncoding.EncodeToString(btwoc(dhGen)),
+		"dh_consumer_public": base64.StdEncoding.EncodeToString(btwoc(s.public)),
+	}
+}
+
+// secret decrypt the enc_mac_key of the associate response with the
+// dh_server_public of the OpenID Server
+func (s *dhSession) secret(serverPublic, encMacKey string) ([]byte, error) {
+	pub, err := base64.StdEncoding.DecodeString(serverPublic)
+	if err != nil || len(pub) == 0 {
+		return nil, fmt.Errorf("invalid dh_server_public")
+	}
+	enc, err := base64.StdEncoding.DecodeString(encMacKey)
+	if err != nil || len(enc) == 0 {
+		return nil, fmt.Errorf("invalid enc_mac_key")
+	}
+
+	y := new(big.Int).SetBytes(pub)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(dhModulus) >= 0 {
+		return nil, fmt.Errorf("invalid dh_server_public")
+	}
+
+	newHash, _ := dhHash(s.sessionType)
+	h := newHash()
+	h.Write(btwoc(new(big.Int).Exp(y, s.private, dhModulus)))
+	key := h.Sum(nil)
+
+	if len(enc) != len(key) {
+		return nil, fmt.Errorf("invalid enc_mac_key of %d bytes", len(enc))
+	}
+
+	secret := make([]byte, len(key))
+	for i := range key {
+		secret[i] = key[i] ^ enc[i]
+	}
+	return secret, nil
+}
+
+// dhHash return the hash function of the Diffie-Hellman session type
+func dhHash(sessionType string) (func() hash.Hash, error) {
+	switch sessionType {
+	case dhSHA1:
+		return sha1.New, nil
+	case dhSHA256:
+		return sha256.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported session type %q", sessionType)
+	}
+}
+
+// btwoc return the big-endian two's complement representation of the non
+// negative x
+func btwoc(x *big.Int) []byte {
+	b := x.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
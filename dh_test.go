@@ -0,0 +1,84 @@
+package openid
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_btwoc(t *testing.T) {
+	for _, tc := range []struct {
+		x    int64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{255, []byte{0x00, 0xff}},
+		{256, []byte{0x01, 0x00}},
+	} {
+		if got := btwoc(big.NewInt(tc.x)); !bytes.Equal(got, tc.want) {
+			t.Errorf("btwoc(%d) %x, want %x", tc.x, got, tc.want)
+		}
+	}
+}
+
+func Test_associate_DH(t *testing.T) {
+	ts := newFakeProvider(t)
+
+	for _, tc := range []struct {
+		assocType string
+		secret    []byte
+	}{
+		{hmacSHA256, fakeSecret},
+		{hmacSHA1, fakeSecret[:20]},
+	} {
+		o := New(realm)
+		if err := o.SetAssocType(tc.assocType); err != nil {
+			t.Fatal(err)
+		}
+
+		assoc, err := o.associate(context.Background(), ts.URL, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.assocType, err)
+		}
+		if assoc.Type != tc.assocType {
+			t.Errorf("association type %q, want %q", assoc.Type, tc.assocType)
+		}
+		if !bytes.Equal(assoc.Secret, tc.secret) {
+			t.Errorf("%s secret %x, want %x", tc.assocType, assoc.Secret, tc.secret)
+		}
+	}
+}
+
+func Test_associate_NoEncryptionRequiresHTTPS(t *testing.T) {
+	prefs := AssocPreference{AssocType: hmacSHA256, SessionType: noEncryption}
+
+	ts := newFakeProvider(t)
+	o := New(realm)
+	if err := o.SetAssocPreferences(prefs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.associate(context.Background(), ts.URL, false); err == nil {
+		t.Errorf("no-encryption association over http should fail")
+	}
+
+	tls := httptest.NewTLSServer(fakeProvider)
+	defer tls.Close()
+
+	o = New(realm)
+	o.client = tls.Client()
+	if err := o.SetAssocPreferences(prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	assoc, err := o.associate(context.Background(), tls.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assoc.Secret, fakeSecret) {
+		t.Errorf("no-encryption secret %x, want %x", assoc.Secret, fakeSecret)
+	}
+}
@@ -0,0 +1,543 @@
+package openid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// contentTypeXRDS is the media type of XRDS documents
+	contentTypeXRDS = "application/xrds+xml"
+	// contentTypeHTML is the media type of HTML pages
+	contentTypeHTML = "text/html"
+	// maxDiscoveryBody limits the documents read by discovery
+	maxDiscoveryBody = 1 << 20
+
+	// discoveryCacheSize is how many claimed identifiers discovered at login
+	// are remembered
+	discoveryCacheSize = 10000
+	// discoveryCacheTTL is how long a claimed identifier discovered at login
+	// is trusted, a login round-trip
+	discoveryCacheTTL = 10 * time.Minute
+)
+
+// discovered is the OpenID Server of an identifier
+type discovered struct {
+	// endpoint is the OpenID Server endpoint.
+	endpoint string
+	// claimedID is sent as openid.claimed_id.
+	claimedID string
+	// localID is sent as openid.identity.
+	localID string
+	// version is the protocol version of the OpenID Server.
+	version ProtocolVersion
+	// returnTo are the return_to urls registered with the OpenID Server,
+	// when advertised by discovery.
+	returnTo []string
+	// displayID is the identifier the user entered, before normalization,
+	// only known at login.
+	displayID string
+}
+
+// cachedDiscovery is a claimed identifier discovered at login
+type cachedDiscovery struct {
+	d       *discovered
+	expires time.Time
+}
+
+// matches report whether the assertion of the normalized claimedID and
+// identity by endpoint agrees with d
+func (d *discovered) matches(endpoint, claimedID, identity string) bool {
+	if id, err := normalizeIdentifier(identity); err == nil {
+		identity = id
+	}
+	return d.claimedID == claimedID && d.localID == identity &&
+		strings.TrimRight(d.endpoint, "/") == strings.TrimRight(endpoint, "/")
+}
+
+// rememberDiscovered remember the claimed identifier d discovered at login
+// to verify its assertion
+func (o *OpenID) rememberDiscovered(d *discovered) {
+	if d.claimedID == ClaimedID {
+		return
+	}
+	o.discoveries.add(d.claimedID,
+		cachedDiscovery{d: d, expires: o.now().Add(discoveryCacheTTL)})
+}
+
+// verifyDiscovered check the claimed_id of the assertion values is served
+// by endpoint with the asserted identity, as discovered at login or else
+// discovered again, so an OpenID Server cannot assert the identifiers of
+// another one. It returns the matching discovery, nil for an assertion
+// about no identifier.
+func (o *OpenID) verifyDiscovered(ctx context.Context,
+	endpoint string, values map[string]string) (*discovered, error) {
+
+	claimedID, identity := values["claimed_id"], values["identity"]
+	if claimedID == "" {
+		// an assertion about no identifier, only carrying extensions
+		if identity != "" {
+			return nil, fmt.Errorf("%w: identity %s without claimed_id",
+				ErrDiscoveryMismatch, identity)
+		}
+		return nil, nil
+	}
+
+	// the fragment of a recycled identifier is not discovered
+	if i := strings.IndexByte(claimedID, '#'); i >= 0 {
+		claimedID = claimedID[:i]
+	}
+	claimedID, err := normalizeIdentifier(claimedID)
+	if err != nil {
+		return nil, &kindError{kind: ErrDiscoveryMismatch, err: err}
+	}
+
+	if v, ok := o.discoveries.get(claimedID); ok {
+		cached := v.(cachedDiscovery)
+		if o.now().Before(cached.expires) &&
+			cached.d.matches(endpoint, claimedID, identity) {
+			return cached.d, nil
+		}
+	}
+
+	d, err := o.discover(ctx, claimedID)
+	if err != nil {
+		return nil, &kindError{kind: ErrDiscoveryMismatch, err: err}
+	}
+	if !d.matches(endpoint, claimedID, identity) {
+		return nil, fmt.Errorf("%w: %s asserted by %s, discovered %s",
+			ErrDiscoveryMismatch, claimedID, endpoint, d.endpoint)
+	}
+	o.rememberDiscovered(d)
+	return d, nil
+}
+
+// displayIdentifier get the identifier to show for the verified assertion
+// values, the one the user entered at login as discovered in d, or else the
+// claimed_id without its fragment
+func displayIdentifier(d *discovered, values map[string]string) string {
+	if d != nil && d.displayID != "" {
+		return d.displayID
+	}
+	claimedID := values["claimed_id"]
+	if i := strings.IndexByte(claimedID, '#'); i >= 0 {
+		claimedID = claimedID[:i]
+	}
+	return claimedID
+}
+
+// Discover the OpenID Server endpoint of a user-supplied identifier, like
+// https://me.example.com/ or the url of an OpenID Server, with Yadis. The
+// claimedID is the normalized identifier, or the identifier_select one for
+// an OpenID Server url.
+func (o *OpenID) Discover(
+	identifier string) (opEndpoint, claimedID string, err error) {
+
+	return o.DiscoverContext(context.Background(), identifier)
+}
+
+// DiscoverContext is Discover with ctx bounding the discovery requests.
+func (o *OpenID) DiscoverContext(ctx context.Context,
+	identifier string) (opEndpoint, claimedID string, err error) {
+
+	d, err := o.discover(ctx, identifier)
+	if err != nil {
+		return "", "", err
+	}
+	o.discoveredVersions.add(strings.TrimRight(d.endpoint, "/"), d.version)
+	return d.endpoint, d.claimedID, nil
+}
+
+// CheckIDSetupIdentifier is CheckIDSetup for a user-supplied identifier,
+// whose OpenID Server is discovered with Discover. The identifier is
+// remembered as the DisplayIdentifier of the assertion.
+func (o *OpenID) CheckIDSetupIdentifier(ctx context.Context,
+	identifier string, callbackPrefix string, optional ...string) (string, error) {
+
+	d, err := o.discover(ctx, identifier)
+	if err != nil {
+		return "", err
+	}
+	d.displayID = strings.TrimSpace(identifier)
+	return o.checkIDSetup(ctx, d, "checkid_setup", callbackPrefix, optional...)
+}
+
+// SetParallelDiscovery run the Yadis and the HTML discovery of identifiers
+// concurrently, the first to succeed wins and the other is cancelled. By
+// default Yadis runs first, falling back to HTML.
+func (o *OpenID) SetParallelDiscovery(parallel bool) {
+	o.parallelDiscovery = parallel
+}
+
+// SetDiscoveryTimeout bound the whole discovery of an identifier, all its
+// XRDS and HTML fetches, by d on top of the context of the caller. It does
+// not apply to the association with the OpenID Server. Zero, the default,
+// disables it.
+func (o *OpenID) SetDiscoveryTimeout(d time.Duration) {
+	o.discoveryTimeout = d
+}
+
+// normalizeIdentifier normalize a user-supplied identifier to an url,
+// XRIs are not supported
+func normalizeIdentifier(identifier string) (string, error) {
+	id := strings.TrimSpace(identifier)
+	if id == "" || strings.ContainsAny(id[:1], "=@+$!(") ||
+		strings.HasPrefix(strings.ToLower(id), "xri://") {
+		return "", fmt.Errorf("%w: unsupported identifier %q",
+			ErrDiscoveryFailed, identifier)
+	}
+
+	if !strings.Contains(id, "://") {
+		id = "http://" + id
+	}
+
+	u, err := url.Parse(id)
+	if err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("%w: invalid identifier %q",
+			ErrDiscoveryFailed, identifier)
+	}
+
+	u.Fragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String(), nil
+}
+
+// discover the OpenID Server of identifier with Yadis, falling back to the
+// link elements of the identifier HTML page
+func (o *OpenID) discover(
+	ctx context.Context, identifier string) (*discovered, error) {
+
+	claimedID, err := normalizeIdentifier(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.discoveryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.discoveryTimeout)
+		defer cancel()
+	}
+
+	if o.parallelDiscovery {
+		return o.discoverParallel(ctx, claimedID)
+	}
+
+	resp, body, err := o.yadisGet(ctx, claimedID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the claimed identifier is the url after redirects
+	claimedID = resp.Request.URL.String()
+
+	if isXRDS(resp.Header.Get("Content-Type")) {
+		return xrdsDiscovered(body, claimedID)
+	}
+
+	links, meta := parseHead(body)
+
+	location := resp.Header.Get("X-XRDS-Location")
+	if location == "" {
+		location = meta["x-xrds-location"]
+	}
+	if location != "" {
+		if d, err := o.discoverXRDS(ctx, resp.Request.URL, location,
+			claimedID); err == nil || len(links) == 0 {
+			return d, err
+		}
+	}
+
+	return htmlDiscovered(links, claimedID)
+}
+
+// discoverParallel discover the OpenID Server of claimedID with Yadis and
+// with the link elements of its HTML page concurrently, returning the first
+// success or else the Yadis error
+func (o *OpenID) discoverParallel(
+	ctx context.Context, claimedID string) (*discovered, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		d   *discovered
+		err error
+	}
+	yadis, html := make(chan result, 1), make(chan result, 1)
+
+	go func() {
+		d, err := o.discoverYadis(ctx, claimedID)
+		yadis <- result{d, err}
+	}()
+	go func() {
+		d, err := o.discoverHTML(ctx, claimedID)
+		html <- result{d, err}
+	}()
+
+	var yadisErr error
+	for yadis != nil || html != nil {
+		select {
+		case r := <-yadis:
+			if r.err == nil {
+				return r.d, nil
+			}
+			yadisErr, yadis = r.err, nil
+		case r := <-html:
+			if r.err == nil {
+				return r.d, nil
+			}
+			html = nil
+		}
+	}
+	return nil, yadisErr
+}
+
+// discoverYadis discover the OpenID Server of claimedID from its XRDS
+// document only
+func (o *OpenID) discoverYadis(
+	ctx context.Context, claimedID string) (*discovered, error) {
+
+	resp, body, err := o.yadisGet(ctx, claimedID)
+	if err != nil {
+		return nil, err
+	}
+	claimedID = resp.Request.URL.String()
+
+	if isXRDS(resp.Header.Get("Content-Type")) {
+		return xrdsDiscovered(body, claimedID)
+	}
+
+	location := resp.Header.Get("X-XRDS-Location")
+	if location == "" {
+		_, meta := parseHead(body)
+		location = meta["x-xrds-location"]
+	}
+	if location == "" {
+		return nil, fmt.Errorf("%w: no XRDS document for %s",
+			ErrDiscoveryFailed, claimedID)
+	}
+	return o.discoverXRDS(ctx, resp.Request.URL, location, claimedID)
+}
+
+// discoverHTML discover the OpenID Server of claimedID from the link
+// elements of its HTML page only
+func (o *OpenID) discoverHTML(
+	ctx context.Context, claimedID string) (*discovered, error) {
+
+	resp, body, err := o.get(ctx, claimedID, contentTypeHTML)
+	if err != nil {
+		return nil, err
+	}
+	if isXRDS(resp.Header.Get("Content-Type")) {
+		return nil, fmt.Errorf("%w: no HTML page for %s",
+			ErrDiscoveryFailed, claimedID)
+	}
+
+	links, _ := parseHead(body)
+	return htmlDiscovered(links, resp.Request.URL.String())
+}
+
+// discoverXRDS discover the OpenID Server of claimedID from the XRDS
+// document at location, relative to base
+func (o *OpenID) discoverXRDS(ctx context.Context,
+	base *url.URL, location, claimedID string) (*discovered, error) {
+
+	u, err := base.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid X-XRDS-Location %q",
+			ErrDiscoveryFailed, location)
+	}
+
+	_, body, err := o.yadisGet(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	return xrdsDiscovered(body, claimedID)
+}
+
+// xrdsDiscovered get the OpenID service of claimedID from a XRDS document
+func xrdsDiscovered(body []byte, claimedID string) (*discovered, error) {
+	services, err := parseXRDS(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscoveryFailed, err)
+	}
+	return selectService(services, claimedID)
+}
+
+// htmlDiscovered get the OpenID service of claimedID from the link elements
+// of its HTML page, like <link rel="openid2.provider" href="...">
+func htmlDiscovered(
+	links map[string]string, claimedID string) (*discovered, error) {
+
+	for _, rel := range []struct {
+		provider, localID string
+		version           ProtocolVersion
+	}{
+		{"openid2.provider", "openid2.local_id", Version20},
+		{"openid.server", "openid.delegate", Version11},
+	} {
+		endpoint := links[rel.provider]
+		if endpoint == "" {
+			continue
+		}
+
+		localID := links[rel.localID]
+		if localID == "" {
+			localID = claimedID
+		}
+		return &discovered{
+			endpoint:  endpoint,
+			claimedID: claimedID,
+			localID:   localID,
+			version:   rel.version,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: no OpenID service for %s",
+		ErrDiscoveryFailed, claimedID)
+}
+
+// yadisGet get urlStr asking for a XRDS document. Only the head of HTML
+// pages is read.
+func (o *OpenID) yadisGet(ctx context.Context,
+	urlStr string) (*http.Response, []byte, error) {
+
+	return o.get(ctx, urlStr, contentTypeXRDS)
+}
+
+// get get urlStr asking for the accept media type. Only the head of HTML
+// pages is read.
+func (o *OpenID) get(ctx context.Context,
+	urlStr, accept string) (*http.Response, []byte, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: %s returned %s",
+			ErrDiscoveryFailed, urlStr, resp.Status)
+	}
+
+	r := io.LimitReader(resp.Body, maxDiscoveryBody)
+	if !isXRDS(resp.Header.Get("Content-Type")) {
+		body, err := readHead(r)
+		return resp, body, err
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// isXRDS report whether contentType is the one of XRDS documents
+func isXRDS(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == contentTypeXRDS
+}
+
+// selectService select the OpenID service of claimedID with the return_to
+// urls advertised
+func selectService(
+	services []xrdsService, claimedID string) (*discovered, error) {
+
+	d, err := selectOpenIDService(services, claimedID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, service := range services {
+		if hasType(service.Type, typeReturnTo) {
+			for _, uri := range service.URI {
+				d.returnTo = append(d.returnTo, strings.TrimSpace(uri))
+			}
+		}
+	}
+	return d, nil
+}
+
+// selectOpenIDService select the OpenID service of claimedID with the
+// highest priority, an OpenID Server service is preferred to a claimed
+// identifier one
+func selectOpenIDService(
+	services []xrdsService, claimedID string) (*discovered, error) {
+
+	sort.SliceStable(services, func(i, j int) bool {
+		return servicePriority(services[i]) < servicePriority(services[j])
+	})
+
+	for _, service := range services {
+		if len(service.URI) > 0 && hasType(service.Type, typeServer) {
+			return &discovered{
+				endpoint:  strings.TrimSpace(service.URI[0]),
+				claimedID: ClaimedID,
+				localID:   Identity,
+				version:   Version20,
+			}, nil
+		}
+	}
+
+	for _, service := range services {
+		if len(service.URI) == 0 || !hasType(service.Type,
+			typeSignon, typeSignon11, typeSignon10) {
+			continue
+		}
+
+		localID := strings.TrimSpace(service.LocalID)
+		if localID == "" {
+			localID = claimedID
+		}
+		return &discovered{
+			endpoint:  strings.TrimSpace(service.URI[0]),
+			claimedID: claimedID,
+			localID:   localID,
+			version:   protocolVersion(service.Type),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: no OpenID service for %s",
+		ErrDiscoveryFailed, claimedID)
+}
+
+// servicePriority get the priority of service, services without one come
+// last
+func servicePriority(service xrdsService) int {
+	p, err := strconv.Atoi(service.Priority)
+	if err != nil || p < 0 {
+		return int(^uint(0) >> 1)
+	}
+	return p
+}
+
+// hasType report whether types has one of want
+func hasType(types []string, want ...string) bool {
+	for _, t := range types {
+		for _, w := range want {
+			if strings.TrimSpace(t) == w {
+				return true
+			}
+		}
+	}
+	return false
+}
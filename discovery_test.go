@@ -0,0 +1,368 @@
+package openid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDiscoveryServer return a server of identifiers discovering op:
+// /op returns an OpenID Server XRDS document directly, /alice points to the
+// XRDS document of a claimed identifier delegating to op by X-XRDS-Location,
+// /carol has HTML links only, /dave points to the XRDS document of /op with a
+// meta http-equiv and /bob has nothing
+func newDiscoveryServer(t *testing.T, op string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/op", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != contentTypeXRDS {
+			t.Errorf("Accept %q, want %q", r.Header.Get("Accept"), contentTypeXRDS)
+		}
+		w.Header().Set("Content-Type", contentTypeXRDS+"; charset=utf-8")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD>
+    <Service priority="10">
+      <Type>%s</Type>
+      <URI>https://backup.example.com/openid</URI>
+    </Service>
+    <Service priority="0">
+      <Type>%s</Type>
+      <URI>%s</URI>
+    </Service>
+  </XRD>
+</xrds:XRDS>`, typeServer, typeServer, op)
+	})
+	mux.HandleFunc("/alice", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-XRDS-Location", "/alice.xrds")
+		fmt.Fprintf(w, "<html><body>alice</body></html>")
+	})
+	mux.HandleFunc("/alice.xrds", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeXRDS)
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD>
+    <Service>
+      <Type>%s</Type>
+      <URI>%s</URI>
+      <LocalID>https://openidprovider.com/id/alice</LocalID>
+    </Service>
+  </XRD>
+</xrds:XRDS>`, typeSignon, op)
+	})
+	mux.HandleFunc("/carol", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><head>
+<link rel="openid2.provider" href="%s">
+<link rel="openid2.local_id" href="https://openidprovider.com/id/carol">
+</head><body>carol</body></html>`, op)
+	})
+	mux.HandleFunc("/dave", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><head>
+<meta http-equiv="X-XRDS-Location" content="/op">
+</head><body>dave</body></html>`)
+	})
+	mux.HandleFunc("/bob", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body>bob</body></html>")
+	})
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func Test_Discover(t *testing.T) {
+	op := "https://openidprovider.com/openid"
+	ts := newDiscoveryServer(t, op)
+	o := New(realm)
+
+	for _, tc := range []struct {
+		identifier, endpoint, claimedID string
+	}{
+		{ts.URL + "/op", op, ClaimedID},
+		{ts.URL + "/alice", op, ts.URL + "/alice"},
+		{ts.URL + "/alice#fragment", op, ts.URL + "/alice"},
+		{ts.URL + "/carol", op, ts.URL + "/carol"},
+		{ts.URL + "/dave", op, ClaimedID},
+	} {
+		endpoint, claimedID, err := o.Discover(tc.identifier)
+		if err != nil {
+			t.Errorf("Discover(%s): %v", tc.identifier, err)
+			continue
+		}
+		if endpoint != tc.endpoint || claimedID != tc.claimedID {
+			t.Errorf("Discover(%s) %s, %s, want %s, %s", tc.identifier,
+				endpoint, claimedID, tc.endpoint, tc.claimedID)
+		}
+	}
+
+	for _, identifier := range []string{ts.URL + "/bob", "=alice", ""} {
+		if _, _, err := o.Discover(identifier); !errors.Is(err, ErrDiscoveryFailed) {
+			t.Errorf("Discover(%q) error %v, want %v",
+				identifier, err, ErrDiscoveryFailed)
+		}
+	}
+}
+
+func Test_SetParallelDiscovery(t *testing.T) {
+	xrdsOP := "https://xrds.example.com/openid"
+	htmlOP := "https://html.example.com/openid"
+
+	// the XRDS document is slower than the HTML page
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") != contentTypeXRDS {
+				fmt.Fprintf(w, `<html><head>
+<link rel="openid2.provider" href="%s"></head></html>`, htmlOP)
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+			w.Header().Set("Content-Type", contentTypeXRDS)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD><Service><Type>%s</Type><URI>%s</URI></Service></XRD>
+</xrds:XRDS>`, typeServer, xrdsOP)
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	for _, tc := range []struct {
+		parallel bool
+		endpoint string
+	}{
+		{false, xrdsOP},
+		{true, htmlOP},
+	} {
+		o.SetParallelDiscovery(tc.parallel)
+
+		endpoint, _, err := o.Discover(ts.URL + "/bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint != tc.endpoint {
+			t.Errorf("parallel %v: endpoint %s, want %s",
+				tc.parallel, endpoint, tc.endpoint)
+		}
+	}
+
+	o.SetParallelDiscovery(true)
+	if _, _, err := o.Discover(newDiscoveryServer(t, xrdsOP).URL +
+		"/bob"); !errors.Is(err, ErrDiscoveryFailed) {
+		t.Errorf("parallel discovery error %v, want %v", err, ErrDiscoveryFailed)
+	}
+}
+
+func Test_CheckIDSetupIdentifier(t *testing.T) {
+	op := newFakeProvider(t)
+	ts := newDiscoveryServer(t, op.URL)
+	o := New(realm)
+
+	urlStr, err := o.CheckIDSetupIdentifier(
+		context.Background(), ts.URL+"/alice", callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := u.Scheme + "://" + u.Host; got != op.URL {
+		t.Errorf("redirect to %s, want %s", got, op.URL)
+	}
+	q := u.Query()
+	if got := q.Get("openid.claimed_id"); got != ts.URL+"/alice" {
+		t.Errorf("claimed_id %q, want %q", got, ts.URL+"/alice")
+	}
+	if got := q.Get("openid.identity"); got != "https://openidprovider.com/id/alice" {
+		t.Errorf("identity %q, want the local identifier", got)
+	}
+}
+
+func Test_IDResUser_DisplayIdentifier(t *testing.T) {
+	op := newFakeProvider(t)
+	ts := newDiscoveryServer(t, op.URL)
+	o := New(realm)
+
+	// the user types the identifier without scheme, discovery normalizes it
+	entered := strings.TrimPrefix(ts.URL, "http://") + "/alice"
+	claimedID := ts.URL + "/alice"
+
+	if _, err := o.CheckIDSetupIdentifier(
+		context.Background(), " "+entered+" ", callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	assoc, ok := o.association(op.URL, 0)
+	if !ok {
+		t.Fatalf("no association with %s", op.URL)
+	}
+
+	user, err := o.IDResUser(idResRequest(t, assoc, map[string]string{
+		"claimed_id": claimedID,
+		"identity":   "https://openidprovider.com/id/alice",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ClaimedID != claimedID || user.DisplayIdentifier != entered {
+		t.Errorf("claimed_id %q, display identifier %q, want %q, %q",
+			user.ClaimedID, user.DisplayIdentifier, claimedID, entered)
+	}
+
+	// without a login through discovery the claimed_id is displayed
+	o = New(realm)
+	o.assocs.Set(op.URL, *assoc)
+	user, err = o.IDResUser(idResRequest(t, assoc, map[string]string{
+		"claimed_id": claimedID + "#recycled",
+		"identity":   "https://openidprovider.com/id/alice",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DisplayIdentifier != claimedID {
+		t.Errorf("display identifier %q, want %q", user.DisplayIdentifier, claimedID)
+	}
+}
+
+func Test_normalizeIdentifier(t *testing.T) {
+	for _, tc := range []struct {
+		identifier, want string
+	}{
+		{"example.com", "http://example.com/"},
+		{" https://example.com/alice#me ", "https://example.com/alice"},
+		{"http://example.com/alice?x=1", "http://example.com/alice?x=1"},
+	} {
+		got, err := normalizeIdentifier(tc.identifier)
+		if err != nil || got != tc.want {
+			t.Errorf("normalizeIdentifier(%q) %q, %v, want %q",
+				tc.identifier, got, err, tc.want)
+		}
+	}
+
+	for _, identifier := range []string{"", "=alice", "xri://=alice", "ftp://x"} {
+		if _, err := normalizeIdentifier(identifier); err == nil {
+			t.Errorf("normalizeIdentifier(%q) should fail", identifier)
+		}
+	}
+}
+
+func Test_CheckIDSetupIdentifier_ReturnToHints(t *testing.T) {
+	op := newFakeProvider(t)
+	registered := realm + "/openid/registered"
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentTypeXRDS)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD>
+    <Service>
+      <Type>%s</Type>
+      <URI>%s</URI>
+    </Service>
+    <Service>
+      <Type>%s</Type>
+      <URI>%s</URI>
+    </Service>
+  </XRD>
+</xrds:XRDS>`, typeServer, op.URL, typeReturnTo, registered)
+		}))
+	defer ts.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	o := New(realm)
+	ctx := context.Background()
+
+	if _, err := o.CheckIDSetupIdentifier(ctx, ts.URL, "/openid/registered"); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("registered return_to warned: %s", logs.String())
+	}
+
+	if _, err := o.CheckIDSetupIdentifier(ctx, ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "is not registered") {
+		t.Errorf("unregistered return_to not warned: %q", logs.String())
+	}
+}
+
+func Test_IDRes_DiscoveryMismatch(t *testing.T) {
+	op := fakeAssociation("https://openidprovider.com/openid")
+	evil := fakeAssociation("https://evil.example.com/openid")
+	ts := newDiscoveryServer(t, op.Endpoint)
+
+	o := New(realm)
+	o.assocs.Set(op.Endpoint, *op)
+	o.assocs.Set(evil.Endpoint, *evil)
+
+	alice := map[string]string{
+		"claimed_id": ts.URL + "/alice",
+		"identity":   "https://openidprovider.com/id/alice",
+	}
+	if _, err := o.IDRes(idResRequest(t, op, alice)); err != nil {
+		t.Errorf("assertion by the discovered OpenID Server: %v", err)
+	}
+
+	_, err := o.IDRes(idResRequest(t, evil, alice))
+	if !errors.Is(err, ErrDiscoveryMismatch) {
+		t.Errorf("assertion by another OpenID Server: %v, want %v",
+			err, ErrDiscoveryMismatch)
+	}
+
+	alice["identity"] = "https://openidprovider.com/id/mallory"
+	_, err = o.IDRes(idResRequest(t, op, alice))
+	if !errors.Is(err, ErrDiscoveryMismatch) {
+		t.Errorf("another local identifier: %v, want %v",
+			err, ErrDiscoveryMismatch)
+	}
+}
+
+func Test_SetDiscoveryTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	o.SetDiscoveryTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	_, _, err := o.Discover(ts.URL + "/slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow XRDS error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("discovery took %v despite the timeout", d)
+	}
+
+	// the context of the caller still applies
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	o.SetDiscoveryTimeout(time.Hour)
+	if _, _, err := o.DiscoverContext(ctx, ts.URL+"/slow"); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled discovery error %v, want %v", err, context.Canceled)
+	}
+}
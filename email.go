@@ -0,0 +1,53 @@
+package openid
+
+import "strings"
+
+// axTypeEmail is the AX attribute type of email addresses
+const axTypeEmail = "http://axschema.org/contact/email"
+
+// EmailCanonicalization is how the email of a verified user is made a
+// stable key.
+type EmailCanonicalization int
+
+const (
+	// EmailRaw keeps the email as returned by the OpenID Server.
+	EmailRaw EmailCanonicalization = iota
+	// EmailLowercase lowercases the email.
+	EmailLowercase
+	// EmailGmail lowercases the email and drops the dots of the local part
+	// of gmail.com addresses, which Gmail ignores.
+	EmailGmail
+)
+
+// SetEmailCanonicalization canonicalize the sreg or AX email of verified
+// users, returned as "canonical_email" in the user values next to the raw
+// email. Emails are kept raw only by default.
+func (o *OpenID) SetEmailCanonicalization(c EmailCanonicalization) {
+	o.emailCanonicalization = c
+}
+
+// email get the sreg email of user, or the AX one
+func email(user map[string]string, ax map[string][]string) (string, bool) {
+	if v, ok := user["sreg.email"]; ok {
+		return v, true
+	}
+	return axValue(user, ax, axTypeEmail)
+}
+
+// canonicalEmail canonicalize addr following c
+func canonicalEmail(addr string, c EmailCanonicalization) string {
+	if c == EmailRaw {
+		return addr
+	}
+
+	addr = strings.ToLower(strings.TrimSpace(addr))
+	if c != EmailGmail {
+		return addr
+	}
+
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || addr[i+1:] != "gmail.com" {
+		return addr
+	}
+	return strings.ReplaceAll(addr[:i], ".", "") + addr[i:]
+}
@@ -0,0 +1,68 @@
+package openid
+
+import "testing"
+
+func Test_SetEmailCanonicalization(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	fields := map[string]string{
+		"ns.sreg":    NSSreg,
+		"sreg.email": "Alice@Example.COM",
+	}
+
+	user, err := o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := user["canonical_email"]; ok {
+		t.Errorf("canonical_email should be absent by default")
+	}
+
+	o.SetEmailCanonicalization(EmailLowercase)
+	user, err = o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user["canonical_email"]; got != "alice@example.com" {
+		t.Errorf("canonical_email %q, want %q", got, "alice@example.com")
+	}
+	if got := user["sreg.email"]; got != "Alice@Example.COM" {
+		t.Errorf("raw sreg.email %q should be kept", got)
+	}
+
+	// AX email
+	user, err = o.IDRes(idResRequest(t, assoc, map[string]string{
+		"ns.ext1":         NSAX,
+		"ext1.mode":       "fetch_response",
+		"ext1.type.mail":  axTypeEmail,
+		"ext1.value.mail": "Bob@Example.com",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user["canonical_email"]; got != "bob@example.com" {
+		t.Errorf("AX canonical_email %q, want %q", got, "bob@example.com")
+	}
+}
+
+func Test_canonicalEmail(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		c    EmailCanonicalization
+		want string
+	}{
+		{"Alice.Liddell@GMail.com", EmailRaw, "Alice.Liddell@GMail.com"},
+		{"Alice.Liddell@GMail.com", EmailLowercase, "alice.liddell@gmail.com"},
+		{"Alice.Liddell@GMail.com", EmailGmail, "aliceliddell@gmail.com"},
+		{"alice.liddell@example.com", EmailGmail, "alice.liddell@example.com"},
+		{" alice@example.com ", EmailLowercase, "alice@example.com"},
+	} {
+		if got := canonicalEmail(tc.addr, tc.c); got != tc.want {
+			t.Errorf("canonicalEmail(%q, %d) %q, want %q",
+				tc.addr, tc.c, got, tc.want)
+		}
+	}
+}
@@ -4,22 +4,75 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"strings"
 )
 
-// parseHTTP parses openid values from url.Values
+// openidPrefix is the prefix of openid keys in http values
+const openidPrefix = "openid."
+
+// maxCallbackBody limits the form body of POST callbacks
+const maxCallbackBody = 1 << 20
+
+// callbackValues get the values of the callback r, from the query string of
+// redirects or the form body of POST callbacks, which OpenID Servers use for
+// large assertions
+func callbackValues(r *http.Request) (url.Values, error) {
+	if r.Method != http.MethodPost {
+		return r.URL.Query(), nil
+	}
+
+	if r.PostForm == nil && r.Body != nil {
+		r.Body = http.MaxBytesReader(nil, r.Body, maxCallbackBody)
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("parse callback form failed: %w", err)
+	}
+	return r.Form, nil
+}
+
+// parseHTTP parses openid values from url.Values. The "openid." prefix is
+// matched case-insensitively, the rest of the key is kept as is. Of keys
+// differing only by the case of their prefix, like "openid.mode" and
+// "OpenID.mode", the exact "openid." one wins, else the smallest key, so
+// the map order never decides.
 func parseHTTP(v url.Values) map[string]string {
-	p := make(map[string]string)
+	// nearly all values of a callback are openid values
+	p := make(map[string]string, len(v))
+	// from is the key each value was taken from, only for mixed case ones
+	var from map[string]string
+
 	for k, v := range v {
-		if strings.HasPrefix(k, "openid.") && len(v) > 0 {
-			p[strings.TrimPrefix(k, "openid.")] = v[0]
+		if len(v) == 0 || len(k) <= len(openidPrefix) ||
+			!strings.EqualFold(k[:len(openidPrefix)], openidPrefix) {
+			continue
+		}
+
+		name := k[len(openidPrefix):]
+		if _, ok := p[name]; ok {
+			taken, mixed := from[name]
+			if !mixed || (!strings.HasPrefix(k, openidPrefix) && taken < k) {
+				continue
+			}
+		}
+
+		p[name] = v[0]
+		if strings.HasPrefix(k, openidPrefix) {
+			delete(from, name)
+		} else {
+			if from == nil {
+				from = make(map[string]string)
+			}
+			from[name] = k
 		}
 	}
 	return p
 }
 
-// encodeHTTP encode url values from openid values
+// encodeHTTP encode url values from openid values. Each key is set exactly
+// once and url.Values.Encode sorts by key, so identical inputs always encode
+// to byte-identical output.
 func encodeHTTP(v url.Values, p map[string]string) {
 	for k, pv := range p {
 		v.Set("openid."+k, pv)
@@ -42,8 +95,17 @@ func parseKeyValue(body []byte) (map[string]string, error) {
 	return p, nil
 }
 
-// writeKeyValuePair write a key value pair to io.Writer
+// writeKeyValuePair write a key value pair to io.Writer. Keys containing ':'
+// or newlines and values containing newlines are rejected, they would
+// inject extra pairs into the key-value form.
 func writeKeyValuePair(w io.Writer, key, value string) error {
+	if strings.ContainsAny(key, ":\n") {
+		return fmt.Errorf("invalid key-value key %q", key)
+	}
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("invalid key-value value for %q", key)
+	}
+
 	_, err := fmt.Fprintf(w, "%s:%s\n", key, value)
 	return err
 }
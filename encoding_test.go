@@ -0,0 +1,86 @@
+package openid
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// axResponse build callback values of an AX response with n attributes
+func axResponse(n int) url.Values {
+	v := url.Values{}
+	v.Set("openid.ns", Namespace)
+	v.Set("openid.mode", "id_res")
+	v.Set("openid.ns.ax", "http://openid.net/srv/ax/1.0")
+	v.Set("openid.ax.mode", "fetch_response")
+	for i := 0; i < n; i++ {
+		v.Set(fmt.Sprintf("openid.ax.type.attr%d", i),
+			fmt.Sprintf("http://axschema.org/attr%d", i))
+		v.Set(fmt.Sprintf("openid.ax.value.attr%d", i),
+			fmt.Sprintf("value %d", i))
+	}
+	v.Set("state", "not an openid value")
+	return v
+}
+
+func Test_parseHTTP(t *testing.T) {
+	v := url.Values{}
+	v.Set("openid.mode", "id_res")
+	v.Set("openid.sreg.email", "alice@example.com")
+	v["openid.empty"] = []string{}
+	v.Set("state", "xyz")
+
+	want := map[string]string{
+		"mode":       "id_res",
+		"sreg.email": "alice@example.com",
+	}
+	if got := parseHTTP(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHTTP %v, want %v", got, want)
+	}
+}
+
+func Test_parseHTTP_MixedCase(t *testing.T) {
+	v := url.Values{}
+	v.Set("OpenID.mode", "id_res")
+	v.Set("OPENID.sreg.Email", "alice@example.com")
+	v.Set("openidx.mode", "cancel")
+
+	want := map[string]string{
+		"mode":       "id_res",
+		"sreg.Email": "alice@example.com",
+	}
+	if got := parseHTTP(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHTTP %v, want %v", got, want)
+	}
+}
+
+func Test_parseHTTP_Collision(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		v := url.Values{}
+		v.Set("OpenID.mode", "cancel")
+		v.Set("openid.mode", "id_res")
+		v.Set("OPENID.mode", "error")
+		v.Set("OpenID.sreg.email", "mallory@example.com")
+		v.Set("OPENID.sreg.email", "alice@example.com")
+
+		got := parseHTTP(v)
+		if got["mode"] != "id_res" {
+			t.Fatalf("mode %q, want the openid.mode value", got["mode"])
+		}
+		if got["sreg.email"] != "alice@example.com" {
+			t.Fatalf("sreg.email %q, want the smallest key value",
+				got["sreg.email"])
+		}
+	}
+}
+
+func Benchmark_parseHTTP(b *testing.B) {
+	v := axResponse(50)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		parseHTTP(v)
+	}
+}
@@ -0,0 +1,267 @@
+package openid
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrAssociateFailed is returned when no association could be
+	// established with an OpenID Server, wrapping the cause.
+	ErrAssociateFailed = errors.New("associate with OpenID Server failed")
+
+	// ErrNoAssociation is returned when an assertion is not signed with a
+	// known association and the OpenID Server did not verify it directly,
+	// wrapping the cause.
+	ErrNoAssociation = errors.New("no association")
+
+	// ErrSignatureMismatch is returned when the signature of an assertion
+	// does not match and the OpenID Server did not verify it directly,
+	// wrapping the cause.
+	ErrSignatureMismatch = errors.New("signature mismatch")
+
+	// ErrUserCancelled is returned when the user cancelled the login at the
+	// OpenID Server, as a *CancelError with the reason.
+	ErrUserCancelled = errors.New("user cancelled")
+
+	// ErrProviderError is returned when the OpenID Server redirects back
+	// with openid.mode error, wrapped with its openid.error message.
+	ErrProviderError = errors.New("OpenID Server error")
+
+	// ErrSetupNeeded is returned by IDRes when the OpenID Server answers
+	// CheckIDImmediate with setup_needed.
+	ErrSetupNeeded = errors.New("setup needed")
+
+	// ErrEndpointNotAllowed is returned when the OpenID Server endpoint is
+	// not in the allowed endpoints.
+	ErrEndpointNotAllowed = errors.New("endpoint not allowed")
+
+	// ErrEndpointUnknown is returned when an assertion not signed with an
+	// association names an endpoint neither allowed nor logged in with, to
+	// verify it directly.
+	ErrEndpointUnknown = errors.New("unknown endpoint")
+
+	// ErrDiscoveryFailed is returned when no OpenID Server is discovered
+	// for an identifier.
+	ErrDiscoveryFailed = errors.New("discovery failed")
+
+	// ErrDiscoveryMismatch is returned when the claimed_id of an assertion
+	// is not discovered to be served by the asserting OpenID Server.
+	ErrDiscoveryMismatch = errors.New("claimed_id not served by the OpenID Server")
+
+	// ErrEndpointChanged is returned when a claimed_id is asserted by
+	// another endpoint than the pinned one.
+	ErrEndpointChanged = errors.New("endpoint changed")
+
+	// ErrCertificatePinMismatch is returned when the TLS certificate of an
+	// endpoint does not match its pinned certificates.
+	ErrCertificatePinMismatch = errors.New("certificate pin mismatch")
+
+	// ErrIdentityNotAllowed is returned when a verified claimed_id is denied
+	// or not allowed by the identity filter.
+	ErrIdentityNotAllowed = errors.New("identity not allowed")
+
+	// ErrCertificateHostMismatch is returned when the TLS certificate of an
+	// endpoint is not valid for the endpoint host.
+	ErrCertificateHostMismatch = errors.New("certificate host mismatch")
+
+	// ErrInsecureIdentity is returned when the claimed_id is not an https
+	// url and SetRequireHTTPSIdentity is enabled.
+	ErrInsecureIdentity = errors.New("insecure identity")
+
+	// ErrFieldNotSigned is returned when an OpenID 2.0 assertion does not
+	// sign a field it has to, like op_endpoint or claimed_id.
+	ErrFieldNotSigned = errors.New("required field not signed")
+
+	// ErrNonceNotSigned is returned when an assertion carries a
+	// response_nonce which is not signed.
+	ErrNonceNotSigned = errors.New("response_nonce not signed")
+
+	// ErrNonceMissing is returned when an OpenID 2.0 assertion carries no
+	// response_nonce, or the return_to of an OpenID 1.1 one no nonce.
+	ErrNonceMissing = errors.New("response_nonce missing")
+
+	// ErrNonceReplayed is returned when the response_nonce of an assertion
+	// was already seen.
+	ErrNonceReplayed = errors.New("response_nonce replayed")
+
+	// ErrNonceExpired is returned when the response_nonce of an assertion
+	// is older than the nonce window.
+	ErrNonceExpired = errors.New("response_nonce expired")
+
+	// ErrNonceStoreFailed is returned when the NonceStore cannot tell
+	// whether a response_nonce was already seen, with the FailClosed
+	// policy.
+	ErrNonceStoreFailed = errors.New("nonce store failed")
+
+	// ErrWeakAssociationKey is returned when an OpenID Server hands out an
+	// association secret of the wrong length or all-zero.
+	ErrWeakAssociationKey = errors.New("weak association key")
+
+	// ErrWeakAssoc is returned when an assertion is signed with an
+	// association type weaker than the one set by SetMinAssocType.
+	ErrWeakAssoc = errors.New("weak association type")
+
+	// ErrRealmMismatch is returned when the return_to of an assertion is
+	// not under the realm.
+	ErrRealmMismatch = errors.New("return_to not under realm")
+
+	// ErrReturnToMismatch is returned when the return_to of an assertion
+	// does not match the url the OpenID Server redirected to.
+	ErrReturnToMismatch = errors.New("return_to does not match request")
+
+	// ErrAssertionBeforeAssociation is returned when an assertion was
+	// issued before the creation of the association it is signed with.
+	ErrAssertionBeforeAssociation = errors.New(
+		"assertion issued before association")
+
+	// ErrDirectVerifyFailed is returned when the OpenID Server does not
+	// confirm an assertion with check_authentication.
+	ErrDirectVerifyFailed = errors.New("check_authentication failed")
+
+	// ErrAssociateRejected is returned when an OpenID Server rejects an
+	// association request with a client error, retrying will not help.
+	ErrAssociateRejected = errors.New("association rejected")
+
+	// ErrIncompleteAssociation is returned when an association response is
+	// truncated or misses mandatory keys.
+	ErrIncompleteAssociation = errors.New("incomplete association response")
+)
+
+// directError is an error direct response from an OpenID Server
+type directError struct {
+	values map[string]string
+}
+
+// Error return the error message of the OpenID Server
+func (e *directError) Error() string {
+	if code := e.values["error_code"]; code != "" {
+		return fmt.Sprintf("OpenID Server error %q (%s)", e.values["error"], code)
+	}
+	return fmt.Sprintf("OpenID Server error %q", e.values["error"])
+}
+
+// suggestion return the association and session types an OpenID Server
+// suggests with an unsupported-type error, if they are usable with endpoint
+func (e *directError) suggestion(endpoint string) (AssocPreference, bool) {
+	if e.values["error_code"] != "unsupported-type" {
+		return AssocPreference{}, false
+	}
+
+	pref := AssocPreference{
+		AssocType:   e.values["assoc_type"],
+		SessionType: e.values["session_type"],
+	}
+	if pref.check() != nil {
+		return AssocPreference{}, false
+	}
+	if pref.SessionType == noEncryption && !isHTTPS(endpoint) {
+		return AssocPreference{}, false
+	}
+	return pref, true
+}
+
+// ResponseError is a failed association or check_authentication request to
+// which the OpenID Server responded, with the response status and headers
+// for diagnostics, like the rate limits. Direct responses carry no secrets
+// in headers.
+type ResponseError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Header holds the headers of the response.
+	Header http.Header
+	// Err is the failure.
+	Err error
+}
+
+// Error return the failure
+func (e *ResponseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap return the failure
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// responseError wrap a non-nil err with the status and headers of resp
+func responseError(resp *http.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ResponseError{StatusCode: resp.StatusCode, Header: resp.Header, Err: err}
+}
+
+// defaultCancelReason is the reason of cancellations without one
+const defaultCancelReason = "cancelled at the OpenID Server"
+
+// cancelReasonFields are the fields OpenID Servers explain a cancellation
+// with, in order of preference
+var cancelReasonFields = []string{"reason", "cancel_reason", "error"}
+
+// CancelError is the cancellation of the login at the OpenID Server, it
+// matches ErrUserCancelled with errors.Is.
+type CancelError struct {
+	// Reason is the reason given by the OpenID Server, or a generic one.
+	Reason string
+}
+
+// Error return ErrUserCancelled with the reason
+func (e *CancelError) Error() string {
+	return ErrUserCancelled.Error() + ": " + e.Reason
+}
+
+// Is report whether target is ErrUserCancelled
+func (e *CancelError) Is(target error) bool {
+	return target == ErrUserCancelled
+}
+
+// cancelError get the CancelError of the cancel response values, with the
+// reason of the response or of one of its extensions, like "pape.reason"
+func cancelError(values map[string]string) *CancelError {
+	for _, field := range cancelReasonFields {
+		if reason := strings.TrimSpace(values[field]); reason != "" {
+			return &CancelError{Reason: reason}
+		}
+	}
+
+	var keys []string
+	for k := range values {
+		if strings.HasSuffix(k, ".reason") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if reason := strings.TrimSpace(values[k]); reason != "" {
+			return &CancelError{Reason: reason}
+		}
+	}
+
+	return &CancelError{Reason: defaultCancelReason}
+}
+
+// kindError is an error of a kind, one of the sentinel errors, wrapping its
+// cause so errors.Is matches both
+type kindError struct {
+	kind error
+	err  error
+}
+
+// Error return the kind and the cause
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+// Is report whether target is the kind of e
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Unwrap return the cause
+func (e *kindError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,94 @@
+package openid
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_IDRes_ErrorKinds(t *testing.T) {
+	endpoint := newCheckAuthProvider(t, false, "").URL
+	assoc := fakeAssociation(endpoint)
+
+	o := New(realm)
+	logInWith(o, endpoint)
+
+	// not signed with a known association
+	_, err := o.IDRes(idResRequest(t, assoc, nil))
+	if !errors.Is(err, ErrNoAssociation) {
+		t.Errorf("unknown association: %v, want %v", err, ErrNoAssociation)
+	}
+	if !errors.Is(err, ErrDirectVerifyFailed) {
+		t.Errorf("unknown association: %v, want %v", err, ErrDirectVerifyFailed)
+	}
+
+	// signed with another secret than the stored one
+	stored := *assoc
+	stored.Secret = []byte("another secret of thirty-two byte")
+	o.assocs.Set(endpoint, stored)
+
+	_, err = o.IDRes(idResRequest(t, assoc, nil))
+	if !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("signature mismatch: %v, want %v", err, ErrSignatureMismatch)
+	}
+	if !errors.Is(err, ErrDirectVerifyFailed) {
+		t.Errorf("signature mismatch: %v, want %v", err, ErrDirectVerifyFailed)
+	}
+
+	r := httptest.NewRequest("GET",
+		callbackPrefix+"?openid.ns="+Namespace+"&openid.mode=cancel", nil)
+	if _, err := o.IDRes(r); !errors.Is(err, ErrUserCancelled) {
+		t.Errorf("cancel: %v, want %v", err, ErrUserCancelled)
+	}
+}
+
+func Test_IDRes_CancelReason(t *testing.T) {
+	o := New(realm)
+
+	for query, want := range map[string]string{
+		"":                        defaultCancelReason,
+		"&openid.reason=declined": "declined",
+		"&openid.ns.pape=x&openid.pape.reason=policy+not+met": "policy not met",
+	} {
+		r := httptest.NewRequest("GET", callbackPrefix+
+			"?openid.ns="+Namespace+"&openid.mode=cancel"+query, nil)
+
+		_, err := o.IDRes(r)
+		if !errors.Is(err, ErrUserCancelled) {
+			t.Errorf("cancel%s: %v, want %v", query, err, ErrUserCancelled)
+		}
+		var cancelErr *CancelError
+		if !errors.As(err, &cancelErr) || cancelErr.Reason != want {
+			t.Errorf("cancel%s: %v, want reason %q", query, err, want)
+		}
+	}
+}
+
+func Test_IDRes_Modes(t *testing.T) {
+	o := New(realm)
+
+	for query, want := range map[string]error{
+		"openid.mode=cancel":                    ErrUserCancelled,
+		"openid.mode=error&openid.error=denied": ErrProviderError,
+		"openid.mode=checkid_setup":             nil,
+		"openid.op_endpoint=https://op.example": nil,
+	} {
+		r := httptest.NewRequest("GET", callbackPrefix+"?"+query, nil)
+
+		_, err := o.IDRes(r)
+		if err == nil {
+			t.Errorf("%s: no error", query)
+			continue
+		}
+		if want != nil && !errors.Is(err, want) {
+			t.Errorf("%s: %v, want %v", query, err, want)
+		}
+	}
+
+	r := httptest.NewRequest("GET",
+		callbackPrefix+"?openid.mode=error&openid.error=denied", nil)
+	if _, err := o.IDRes(r); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("error mode %v, want the openid.error message", err)
+	}
+}
@@ -0,0 +1,38 @@
+package openid
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// formTemplate is a self-submitting form posting the request to the OpenID
+// Server, for requests too long for a redirect url
+var formTemplate = template.Must(template.New("form").Parse(`<!DOCTYPE html>
+<html>
+<head><title>OpenID</title></head>
+<body onload="document.forms[0].submit()">
+<form method="post" action="{{.Action}}">
+{{range $k, $v := .Values}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<noscript><input type="submit" value="Continue"></noscript>
+</form>
+</body>
+</html>
+`))
+
+// writeForm write a self-submitting form posting urlStr query to its path
+func writeForm(rw http.ResponseWriter, urlStr string) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+
+	values := u.Query()
+	u.RawQuery = ""
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return formTemplate.Execute(rw, struct {
+		Action string
+		Values url.Values
+	}{u.String(), values})
+}
@@ -0,0 +1,151 @@
+package openid
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"strings"
+)
+
+// readHead read r up to the end of the HTML head, or the start of the body
+func readHead(r io.Reader) ([]byte, error) {
+	var head []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		head = append(head, buf[:n]...)
+
+		// the end tag might straddle two reads
+		tail := head
+		if len(tail) > n+6 {
+			tail = tail[len(tail)-n-6:]
+		}
+		lower := bytes.ToLower(tail)
+		if bytes.Contains(lower, []byte("</head")) ||
+			bytes.Contains(lower, []byte("<body")) {
+			return head, nil
+		}
+
+		if err == io.EOF {
+			return head, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseHead get the link relations and the http-equiv meta values of an
+// HTML head, keyed by lowercase rel or http-equiv. The first link of a
+// relation wins.
+func parseHead(head []byte) (links, meta map[string]string) {
+	links = make(map[string]string)
+	meta = make(map[string]string)
+
+	s := string(head)
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			return links, meta
+		}
+		s = s[i+1:]
+
+		if strings.HasPrefix(s, "!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				return links, meta
+			}
+			s = s[end+3:]
+			continue
+		}
+
+		name := tagName(s)
+		s = s[len(name):]
+
+		attrs, rest := parseAttrs(s)
+		s = rest
+
+		switch strings.ToLower(name) {
+		case "link":
+			for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+				if _, ok := links[rel]; !ok {
+					links[rel] = strings.TrimSpace(attrs["href"])
+				}
+			}
+		case "meta":
+			if equiv := strings.ToLower(attrs["http-equiv"]); equiv != "" {
+				meta[equiv] = strings.TrimSpace(attrs["content"])
+			}
+		case "/head", "body":
+			return links, meta
+		}
+	}
+}
+
+// tagName get the tag name at the start of s, "/head" for an end tag
+func tagName(s string) string {
+	i := 0
+	if strings.HasPrefix(s, "/") {
+		i++
+	}
+	for i < len(s) && (isASCIILetter(s[i]) || s[i] >= '0' && s[i] <= '9') {
+		i++
+	}
+	return s[:i]
+}
+
+// parseAttrs parse the attributes of a tag up to its closing '>', returning
+// them by lowercase name with the rest of s
+func parseAttrs(s string) (map[string]string, string) {
+	attrs := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n\f/")
+		if s == "" {
+			return attrs, s
+		}
+		if s[0] == '>' {
+			return attrs, s[1:]
+		}
+
+		i := strings.IndexAny(s, " \t\r\n\f/=>")
+		if i < 0 {
+			return attrs, ""
+		}
+		if i == 0 {
+			// a stray '=' without name
+			s = s[1:]
+			continue
+		}
+		name := strings.ToLower(s[:i])
+		s = strings.TrimLeft(s[i:], " \t\r\n\f")
+
+		if !strings.HasPrefix(s, "=") {
+			attrs[name] = ""
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t\r\n\f")
+
+		var value string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			end := strings.IndexByte(s[1:], s[0])
+			if end < 0 {
+				return attrs, ""
+			}
+			value, s = s[1:end+1], s[end+2:]
+		} else {
+			end := strings.IndexAny(s, " \t\r\n\f>")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = html.UnescapeString(value)
+		}
+	}
+}
+
+// isASCIILetter report whether c is an ASCII letter
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
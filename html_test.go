@@ -0,0 +1,61 @@
+package openid
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseHead(t *testing.T) {
+	head := `<!DOCTYPE html>
+<html><HEAD>
+<!-- <link rel="openid2.provider" href="https://commented.example.com/"> -->
+<meta http-equiv="X-XRDS-Location" content="https://example.com/xrds">
+<LINK REL="openid2.provider openid.server" HREF='https://op.example.com/openid?a=1&amp;b=2'>
+<link rel=openid2.local_id href=https://example.com/id/alice />
+<link rel="openid2.provider" href="https://second.example.com/">
+</head>
+<body><link rel="openid.delegate" href="https://body.example.com/"></body>`
+
+	links, meta := parseHead([]byte(head))
+
+	wantLinks := map[string]string{
+		"openid2.provider": "https://op.example.com/openid?a=1&b=2",
+		"openid.server":    "https://op.example.com/openid?a=1&b=2",
+		"openid2.local_id": "https://example.com/id/alice",
+	}
+	if !reflect.DeepEqual(links, wantLinks) {
+		t.Errorf("links %v, want %v", links, wantLinks)
+	}
+
+	wantMeta := map[string]string{"x-xrds-location": "https://example.com/xrds"}
+	if !reflect.DeepEqual(meta, wantMeta) {
+		t.Errorf("meta %v, want %v", meta, wantMeta)
+	}
+}
+
+// errReader fails any read
+type errReader struct{}
+
+// Read return an error
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read past the head")
+}
+
+func Test_readHead(t *testing.T) {
+	page := "<html><head><title>alice</title></head><body>"
+	head, err := readHead(io.MultiReader(strings.NewReader(page), errReader{}))
+	if err != nil {
+		t.Fatalf("readHead should stop at the end of the head: %v", err)
+	}
+	if string(head) != page {
+		t.Errorf("head %q, want %q", head, page)
+	}
+
+	head, err = readHead(strings.NewReader("<link rel=x href=y>"))
+	if err != nil || string(head) != "<link rel=x href=y>" {
+		t.Errorf("readHead of a headless page %q, %v", head, err)
+	}
+}
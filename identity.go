@@ -0,0 +1,57 @@
+package openid
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SetIdentityFilter restrict the claimed_ids accepted by IDRes, like for an
+// invite-only site. allow and deny hold exact claimed_ids or path.Match
+// patterns, like "https://openidprovider.com/id/*". A denied claimed_id is
+// rejected, then if allow is not empty the claimed_id has to match it.
+func (o *OpenID) SetIdentityFilter(allow, deny []string) error {
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid identity pattern %q: %w", pattern, err)
+		}
+	}
+
+	o.identityAllow = append([]string(nil), allow...)
+	o.identityDeny = append([]string(nil), deny...)
+	return nil
+}
+
+// SetRequireHTTPSIdentity reject in IDRes the claimed_ids which are not
+// https urls, like http://me.example.com/, disabled by default.
+func (o *OpenID) SetRequireHTTPSIdentity(require bool) {
+	o.httpsIdentity = require
+}
+
+// checkIdentity reject claimedID if it is insecure, denied or not allowed
+func (o *OpenID) checkIdentity(claimedID string) error {
+	if o.httpsIdentity {
+		u, err := url.Parse(claimedID)
+		if err != nil || !strings.EqualFold(u.Scheme, "https") || u.Host == "" {
+			return fmt.Errorf("%w: %s", ErrInsecureIdentity, claimedID)
+		}
+	}
+	if identityMatches(o.identityDeny, claimedID) {
+		return fmt.Errorf("%w: %s denied", ErrIdentityNotAllowed, claimedID)
+	}
+	if len(o.identityAllow) > 0 && !identityMatches(o.identityAllow, claimedID) {
+		return fmt.Errorf("%w: %s", ErrIdentityNotAllowed, claimedID)
+	}
+	return nil
+}
+
+// identityMatches report whether claimedID matches one of patterns
+func identityMatches(patterns []string, claimedID string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, claimedID); ok || pattern == claimedID {
+			return true
+		}
+	}
+	return false
+}
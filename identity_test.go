@@ -0,0 +1,66 @@
+package openid
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_SetIdentityFilter(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	err := o.SetIdentityFilter(
+		[]string{"https://openidprovider.com/id/*"},
+		[]string{"https://openidprovider.com/id/mallory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		claimedID string
+		want      error
+	}{
+		{"https://openidprovider.com/id/alice", nil},
+		{"https://openidprovider.com/id/mallory", ErrIdentityNotAllowed},
+		{"https://other.example.com/id/bob", ErrIdentityNotAllowed},
+	} {
+		r := idResRequest(t, assoc, map[string]string{
+			"claimed_id": tc.claimedID,
+			"identity":   tc.claimedID,
+		})
+		if _, err := o.IDRes(r); !errors.Is(err, tc.want) {
+			t.Errorf("%s: IDRes error %v, want %v", tc.claimedID, err, tc.want)
+		}
+	}
+
+	if err := o.SetIdentityFilter([]string{"[bad"}, nil); err == nil {
+		t.Errorf("malformed pattern should fail")
+	}
+}
+
+func Test_SetRequireHTTPSIdentity(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	fields := map[string]string{
+		"claimed_id": "http://me.example.com/",
+		"identity":   "http://me.example.com/",
+	}
+
+	if _, err := o.IDRes(idResRequest(t, assoc, fields)); err != nil {
+		t.Errorf("http claimed_id by default: %v", err)
+	}
+
+	o.SetRequireHTTPSIdentity(true)
+	_, err := o.IDRes(idResRequest(t, assoc, fields))
+	if !errors.Is(err, ErrInsecureIdentity) {
+		t.Errorf("http claimed_id: %v, want %v", err, ErrInsecureIdentity)
+	}
+	if _, err := o.IDRes(idResRequest(t, assoc, nil)); err != nil {
+		t.Errorf("https claimed_id: %v", err)
+	}
+}
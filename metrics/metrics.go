@@ -0,0 +1,67 @@
+/*
+Package metrics provides an openid.Observer recording Prometheus metrics of
+the associations and verifications with OpenID Servers. It is a module on its
+own so that package openid does not depend on Prometheus.
+
+It requires the v0.1.0 release of package openid, the first with Observer.
+To develop it along with package openid, or before that release is tagged,
+use a workspace from the root of the repository, which is not committed:
+
+	go work init . ./metrics
+*/
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shuaiming/openid"
+)
+
+// Observer is an openid.Observer recording the count, result and latency of
+// each phase. OpenID Server endpoints are not recorded, as op_endpoint comes
+// from the User Agent and would make unbounded series.
+type Observer struct {
+	total    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewObserver return an Observer with its metrics registered to reg, like
+// prometheus.DefaultRegisterer.
+func NewObserver(reg prometheus.Registerer) (*Observer, error) {
+	o := &Observer{
+		total: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "openid",
+			Name:      "phase_total",
+			Help:      "OpenID phases, like associate or verify, by result.",
+		}, []string{"phase", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "openid",
+			Name:      "phase_duration_seconds",
+			Help:      "Latency of the OpenID round-trips and verifications.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"phase"}),
+	}
+
+	for _, c := range []prometheus.Collector{o.total, o.duration} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Observe record phase, cached associations count as hits without latency.
+func (o *Observer) Observe(
+	phase openid.Phase, endpoint string, d time.Duration, err error) {
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	o.total.WithLabelValues(string(phase), result).Inc()
+
+	if phase != openid.PhaseAssociateCached {
+		o.duration.WithLabelValues(string(phase)).Observe(d.Seconds())
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shuaiming/openid"
+)
+
+func Test_Observer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	o, err := NewObserver(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var _ openid.Observer = o
+
+	endpoint := "https://openidprovider.com/openid"
+	o.Observe(openid.PhaseAssociate, endpoint, 100*time.Millisecond, nil)
+	o.Observe(openid.PhaseAssociateCached, endpoint, 0, nil)
+	o.Observe(openid.PhaseAssociateCached, endpoint, 0, nil)
+	o.Observe(openid.PhaseVerify, endpoint, time.Millisecond, nil)
+	o.Observe(openid.PhaseVerify, endpoint, time.Millisecond, errors.New("bad"))
+
+	want := `
+# HELP openid_phase_total OpenID phases, like associate or verify, by result.
+# TYPE openid_phase_total counter
+openid_phase_total{phase="associate",result="ok"} 1
+openid_phase_total{phase="associate_cached",result="ok"} 2
+openid_phase_total{phase="verify",result="error"} 1
+openid_phase_total{phase="verify",result="ok"} 1
+`
+	if err := testutil.GatherAndCompare(
+		reg, strings.NewReader(want), "openid_phase_total"); err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(o.duration); n != 2 {
+		t.Errorf("%d latency series, want 2 without cached associations", n)
+	}
+
+	if _, err := NewObserver(reg); err == nil {
+		t.Errorf("registering twice should fail")
+	}
+}
@@ -0,0 +1,263 @@
+package openid
+
+import (
+	"container/heap"
+	"container/list"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseNonceTime get the time of a response_nonce, like
+// 2005-05-15T17:11:51ZUNIQUE
+func parseNonceTime(nonce string) (time.Time, error) {
+	i := strings.IndexByte(nonce, 'Z')
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("invalid response_nonce %q", nonce)
+	}
+
+	t, err := time.Parse(time.RFC3339, nonce[:i+1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid response_nonce %q", nonce)
+	}
+	return t, nil
+}
+
+const (
+	// defaultNonceWindow is how old a response_nonce might be by default
+	defaultNonceWindow = 5 * time.Minute
+	// defaultNonceStoreSize is how many response_nonce are remembered by
+	// default, far more than the assertions of a window on most sites
+	defaultNonceStoreSize = 100000
+)
+
+// NonceStore records the response_nonce of the assertions of each OpenID
+// Server to reject replayed ones. It must be safe for concurrent use.
+type NonceStore interface {
+	// Seen record nonce of endpoint and report whether it was already
+	// recorded.
+	Seen(endpoint, nonce string) bool
+}
+
+// FallibleNonceStore is a NonceStore which might fail, like one backed by a
+// remote database. SeenErr is called instead of Seen, and its error handled
+// following the NonceFailurePolicy.
+type FallibleNonceStore interface {
+	NonceStore
+	// SeenErr record nonce of endpoint and report whether it was already
+	// recorded, or why it cannot tell.
+	SeenErr(endpoint, nonce string) (bool, error)
+}
+
+// NonceFailurePolicy is what IDRes does when the NonceStore fails.
+type NonceFailurePolicy int
+
+const (
+	// FailClosed rejects the assertion with ErrNonceStoreFailed, the
+	// default.
+	FailClosed NonceFailurePolicy = iota
+	// FailOpen accepts the assertion without replay protection, logging a
+	// warning.
+	FailOpen
+)
+
+// MemoryNonceStore is the in memory NonceStore, the default one. It forgets
+// nonces once they are older than its window, and the least recently seen
+// ones beyond its size so memory stays bounded under heavy traffic. A nonce
+// forgotten before it is older than the window could be replayed once, so
+// size the store generously for the assertions of a window.
+type MemoryNonceStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	maxSize int
+	now     func() time.Time
+	// order holds the *nonceEntry, the most recently seen first.
+	order *list.List
+	// expiry holds the elements of order, the soonest expiring first.
+	expiry nonceHeap
+	seen   map[string]*list.Element
+}
+
+// nonceEntry is a nonce remembered by MemoryNonceStore
+type nonceEntry struct {
+	key     string
+	expires time.Time
+	// index is the position of the entry in the expiry heap
+	index int
+}
+
+// nonceHeap is a heap.Interface of the elements of the nonces, by expiry
+type nonceHeap []*list.Element
+
+func (h nonceHeap) Len() int { return len(h) }
+
+func (h nonceHeap) Less(i, j int) bool {
+	return h[i].Value.(*nonceEntry).expires.Before(h[j].Value.(*nonceEntry).expires)
+}
+
+func (h nonceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].Value.(*nonceEntry).index = i
+	h[j].Value.(*nonceEntry).index = j
+}
+
+func (h *nonceHeap) Push(x interface{}) {
+	e := x.(*list.Element)
+	e.Value.(*nonceEntry).index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// NewMemoryNonceStore return a MemoryNonceStore for nonces up to window old,
+// remembering at most maxSize of them, zero for no bound.
+func NewMemoryNonceStore(
+	window time.Duration, maxSize int) *MemoryNonceStore {
+
+	return &MemoryNonceStore{
+		window:  window,
+		maxSize: maxSize,
+		now:     time.Now,
+		order:   list.New(),
+		seen:    map[string]*list.Element{},
+	}
+}
+
+// Seen record nonce of endpoint and report whether it was already recorded
+func (n *MemoryNonceStore) Seen(endpoint, nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+	for n.expiry.Len() > 0 &&
+		now.After(n.expiry[0].Value.(*nonceEntry).expires) {
+		n.forget(n.expiry[0])
+	}
+
+	key := strings.TrimRight(endpoint, "/") + " " + nonce
+	if e, ok := n.seen[key]; ok {
+		n.order.MoveToFront(e)
+		return true
+	}
+
+	// keep nonces without a valid time for a whole window
+	expires := now.Add(n.window)
+	if issued, err := parseNonceTime(nonce); err == nil {
+		expires = issued.Add(n.window)
+	}
+	e := n.order.PushFront(
+		&nonceEntry{key: key, expires: expires.Add(n.window)})
+	n.seen[key] = e
+	heap.Push(&n.expiry, e)
+
+	for n.maxSize > 0 && n.order.Len() > n.maxSize {
+		n.forget(n.order.Back())
+	}
+	return false
+}
+
+// forget the nonce of e
+func (n *MemoryNonceStore) forget(e *list.Element) {
+	entry := e.Value.(*nonceEntry)
+	delete(n.seen, entry.key)
+	heap.Remove(&n.expiry, entry.index)
+	n.order.Remove(e)
+}
+
+// setClock set the clock telling expired nonces
+func (n *MemoryNonceStore) setClock(now func() time.Time) {
+	n.mu.Lock()
+	n.now = now
+	n.mu.Unlock()
+}
+
+// setWindow change how old the nonces to remember might be
+func (n *MemoryNonceStore) setWindow(window time.Duration) {
+	n.mu.Lock()
+	n.window = window
+	n.mu.Unlock()
+}
+
+// SetNonceStore set the store of the response_nonce already seen, a
+// MemoryNonceStore by default. A nil store disables replay protection.
+func (o *OpenID) SetNonceStore(store NonceStore) {
+	o.nonces = store
+	if n, ok := store.(*MemoryNonceStore); ok {
+		n.setClock(o.clock)
+	}
+}
+
+// SetNonceFailurePolicy set what IDRes does when a FallibleNonceStore
+// fails, FailClosed by default.
+func (o *OpenID) SetNonceFailurePolicy(policy NonceFailurePolicy) {
+	o.nonceFailure = policy
+}
+
+// SetNonceWindow set how old, or how far in the future to tolerate clock
+// skew, a response_nonce might be, five minutes by default.
+func (o *OpenID) SetNonceWindow(window time.Duration) {
+	o.nonceWindow = window
+	if n, ok := o.nonces.(*MemoryNonceStore); ok {
+		n.setWindow(window)
+	}
+}
+
+// newNonce build a nonce like a response_nonce, for the return_to of an
+// OpenID 1.1 request. The user has the nonce window to log in.
+func (o *OpenID) newNonce() (string, error) {
+	b, err := o.randomBytes(12)
+	if err != nil {
+		return "", err
+	}
+	return o.now().UTC().Format(time.RFC3339) +
+		base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// clock return the time of o.now, following any later change of o.now
+func (o *OpenID) clock() time.Time {
+	return o.now()
+}
+
+// checkNonce reject a response_nonce of endpoint which is outside the nonce
+// window or was already seen
+func (o *OpenID) checkNonce(endpoint, nonce string) error {
+	issued, err := parseNonceTime(nonce)
+	if err != nil {
+		return err
+	}
+
+	if age := o.now().Sub(issued); age > o.nonceWindow || age < -o.nonceWindow {
+		return fmt.Errorf("%w: issued %s", ErrNonceExpired, issued)
+	}
+
+	seen, err := o.seenNonce(endpoint, nonce)
+	if err != nil {
+		if o.nonceFailure == FailOpen {
+			log.Printf("nonce store failed, replay protection skipped: %v", err)
+			return nil
+		}
+		return &kindError{kind: ErrNonceStoreFailed, err: err}
+	}
+	if seen {
+		return fmt.Errorf("%w: %s", ErrNonceReplayed, nonce)
+	}
+	return nil
+}
+
+// seenNonce record nonce of endpoint in the NonceStore and report whether
+// it was already recorded
+func (o *OpenID) seenNonce(endpoint, nonce string) (bool, error) {
+	if store, ok := o.nonces.(FallibleNonceStore); ok {
+		return store.SeenErr(endpoint, nonce)
+	}
+	return o.nonces.Seen(endpoint, nonce), nil
+}
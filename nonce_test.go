@@ -0,0 +1,289 @@
+package openid
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseNonceTime(t *testing.T) {
+	got, err := parseNonceTime("2005-05-15T17:11:51ZUNIQUE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2005, 5, 15, 17, 11, 51, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("parseNonceTime %v, want %v", got, want)
+	}
+
+	for _, nonce := range []string{"", "UNIQUE", "2005-05-15 17:11:51ZUNIQUE"} {
+		if _, err := parseNonceTime(nonce); err == nil {
+			t.Errorf("parseNonceTime(%q) should fail", nonce)
+		}
+	}
+}
+
+func Test_SetAssociationEpochCheck(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	assoc.Created = time.Now().Add(-time.Minute)
+
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+	o.SetAssociationEpochCheck(true, 5*time.Second)
+
+	nonce := func(t time.Time) map[string]string {
+		return map[string]string{
+			"response_nonce": t.UTC().Format(time.RFC3339) + "unique",
+		}
+	}
+
+	r := idResRequest(t, assoc, nonce(time.Now()))
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("assertion after association: %v", err)
+	}
+
+	r = idResRequest(t, assoc, nonce(assoc.Created.Add(-time.Hour)))
+	if _, err := o.IDRes(r); !errors.Is(err, ErrAssertionBeforeAssociation) {
+		t.Errorf("IDRes error %v, want %v", err, ErrAssertionBeforeAssociation)
+	}
+
+	o.SetAssociationEpochCheck(false, 0)
+	o.SetNonceWindow(2 * time.Hour)
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("disabled check: %v", err)
+	}
+}
+
+func Test_IDRes_NonceReplay(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	nonce := time.Now().UTC().Format(time.RFC3339) + "replay"
+	r := idResRequest(t, assoc, map[string]string{"response_nonce": nonce})
+
+	if _, err := o.IDRes(r); err != nil {
+		t.Fatalf("first callback: %v", err)
+	}
+	if _, err := o.IDRes(r); !errors.Is(err, ErrNonceReplayed) {
+		t.Errorf("replayed callback error %v, want %v", err, ErrNonceReplayed)
+	}
+
+	o.SetNonceStore(nil)
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("disabled replay protection: %v", err)
+	}
+}
+
+func Test_IDRes_NonceWindow(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	for _, tc := range []struct {
+		issued time.Time
+		want   error
+	}{
+		{time.Now().Add(-time.Minute), nil},
+		{time.Now().Add(-10 * time.Minute), ErrNonceExpired},
+		{time.Now().Add(10 * time.Minute), ErrNonceExpired},
+	} {
+		nonce := tc.issued.UTC().Format(time.RFC3339) + "window"
+		r := idResRequest(t, assoc, map[string]string{"response_nonce": nonce})
+		if _, err := o.IDRes(r); !errors.Is(err, tc.want) {
+			t.Errorf("nonce %s: IDRes error %v, want %v", nonce, err, tc.want)
+		}
+	}
+
+	o.SetNonceWindow(time.Hour)
+	nonce := time.Now().Add(-10*time.Minute).UTC().Format(time.RFC3339) + "x"
+	r := idResRequest(t, assoc, map[string]string{"response_nonce": nonce})
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("nonce within a larger window: %v", err)
+	}
+}
+
+func Test_MemoryNonceStore_Seen(t *testing.T) {
+	n := NewMemoryNonceStore(time.Minute, 0)
+	nonce := time.Now().UTC().Format(time.RFC3339) + "abc"
+
+	if n.Seen("https://openidprovider.com/openid", nonce) {
+		t.Errorf("new nonce should not be seen")
+	}
+	if !n.Seen("https://openidprovider.com/openid/", nonce) {
+		t.Errorf("recorded nonce should be seen")
+	}
+	if n.Seen("https://other.example.com/openid", nonce) {
+		t.Errorf("nonces should be per endpoint")
+	}
+
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339) + "old"
+	n.Seen("https://openidprovider.com/openid", old)
+	n.Seen("https://openidprovider.com/openid", "prune")
+	if _, ok := n.seen["https://openidprovider.com/openid "+old]; ok {
+		t.Errorf("nonce older than the window should be forgotten")
+	}
+}
+
+func Test_MemoryNonceStore_MaxSize(t *testing.T) {
+	n := NewMemoryNonceStore(time.Minute, 3)
+	endpoint := "https://openidprovider.com/openid"
+	issued := time.Now().UTC().Format(time.RFC3339)
+
+	for i := 0; i < 10; i++ {
+		n.Seen(endpoint, fmt.Sprintf("%s%d", issued, i))
+	}
+	if len(n.seen) != 3 || n.order.Len() != 3 || n.expiry.Len() != 3 {
+		t.Errorf("%d nonces remembered, want 3", len(n.seen))
+	}
+
+	// seeing a nonce again keeps it over the least recently seen one
+	if !n.Seen(endpoint, issued+"7") {
+		t.Errorf("recent nonce should be seen")
+	}
+	n.Seen(endpoint, issued+"10")
+	if !n.Seen(endpoint, issued+"7") {
+		t.Errorf("recently seen nonce should be kept")
+	}
+	if n.Seen(endpoint, issued+"0") {
+		t.Errorf("least recently seen nonce should be forgotten")
+	}
+}
+
+func Test_MemoryNonceStore_Clock(t *testing.T) {
+	now := time.Now()
+	o := New(realm)
+	o.now = func() time.Time { return now }
+	n := o.nonces.(*MemoryNonceStore)
+	endpoint := "https://openidprovider.com/openid"
+
+	nonce := now.UTC().Format(time.RFC3339) + "clock"
+	n.Seen(endpoint, nonce)
+
+	// expired by the clock of o, not by the wall clock
+	now = now.Add(time.Hour)
+	n.Seen(endpoint, now.UTC().Format(time.RFC3339)+"later")
+	if _, ok := n.seen[endpoint+" "+nonce]; ok {
+		t.Errorf("nonce older than the window should be forgotten")
+	}
+	if len(n.seen) != 1 || n.expiry.Len() != 1 {
+		t.Errorf("%d nonces remembered, want 1", len(n.seen))
+	}
+}
+
+// failingNonceStore is a FallibleNonceStore whose backend is down
+type failingNonceStore struct{}
+
+func (failingNonceStore) Seen(endpoint, nonce string) bool { return false }
+
+func (failingNonceStore) SeenErr(endpoint, nonce string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func Test_SetNonceFailurePolicy(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+	o.SetNonceStore(failingNonceStore{})
+
+	nonce := time.Now().UTC().Format(time.RFC3339) + "down"
+	r := idResRequest(t, assoc, map[string]string{"response_nonce": nonce})
+
+	if _, err := o.IDRes(r); !errors.Is(err, ErrNonceStoreFailed) {
+		t.Errorf("fail closed by default: %v, want %v", err, ErrNonceStoreFailed)
+	}
+
+	o.SetNonceFailurePolicy(FailOpen)
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("fail open: %v", err)
+	}
+	if !strings.Contains(logs.String(), "connection refused") {
+		t.Errorf("no warning logged: %q", logs.String())
+	}
+
+	o.SetNonceFailurePolicy(FailClosed)
+	if _, err := o.IDRes(r); !errors.Is(err, ErrNonceStoreFailed) {
+		t.Errorf("fail closed: %v, want %v", err, ErrNonceStoreFailed)
+	}
+}
+
+func Test_IDRes_ReplayEndToEnd(t *testing.T) {
+	ts := newFakeProvider(t)
+	now := time.Now()
+
+	o := New(realm)
+	o.now = func() time.Time { return now }
+	serveDiscovery(o, ts.URL)
+
+	var verifyErr error
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openid/login", func(w http.ResponseWriter, r *http.Request) {
+		o.RedirectToLogin(w, r, ts.URL, callbackPrefix)
+	})
+	mux.HandleFunc(callbackPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if _, verifyErr = o.IDRes(r); verifyErr != nil {
+			http.Error(w, verifyErr.Error(), http.StatusForbidden)
+		}
+	})
+	serve := func(r *http.Request) int {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	// the login associates with the OpenID Server, which redirects back
+	// with an assertion signed with the association
+	login := func() *http.Request {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/openid/login", nil))
+		if rw.Code != http.StatusFound {
+			t.Fatalf("login status %d, want %d", rw.Code, http.StatusFound)
+		}
+		u, err := url.Parse(rw.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assoc := fakeAssociation(ts.URL)
+		assoc.Handle = u.Query().Get("openid.assoc_handle")
+		return idResRequest(t, assoc, map[string]string{
+			"return_to":      u.Query().Get("openid.return_to"),
+			"response_nonce": now.UTC().Format(time.RFC3339) + "e2e",
+		})
+	}
+
+	callback := login()
+	if code := serve(callback); code != http.StatusOK {
+		t.Fatalf("first callback status %d: %v", code, verifyErr)
+	}
+	callback = httptest.NewRequest(http.MethodGet, callback.URL.String(), nil)
+	if code := serve(callback); code != http.StatusForbidden ||
+		!errors.Is(verifyErr, ErrNonceReplayed) {
+		t.Errorf("replayed callback status %d, error %v, want %d, %v",
+			code, verifyErr, http.StatusForbidden, ErrNonceReplayed)
+	}
+
+	// replayed once the nonce window is over
+	now = now.Add(defaultNonceWindow + time.Minute)
+	callback = httptest.NewRequest(http.MethodGet, callback.URL.String(), nil)
+	if code := serve(callback); code != http.StatusForbidden ||
+		!errors.Is(verifyErr, ErrNonceExpired) {
+		t.Errorf("expired callback status %d, error %v, want %d, %v",
+			code, verifyErr, http.StatusForbidden, ErrNonceExpired)
+	}
+}
@@ -0,0 +1,73 @@
+package openid
+
+import (
+	"fmt"
+	"time"
+)
+
+// Phase is a phase of the OpenID flow reported to the Observer.
+type Phase string
+
+const (
+	// PhaseAssociate is the association round-trip with the OpenID Server.
+	PhaseAssociate Phase = "associate"
+	// PhaseAssociateCached is an association found in the store, without
+	// round-trip.
+	PhaseAssociateCached Phase = "associate_cached"
+	// PhaseCheckIDSetup is the building of the checkid_setup request url,
+	// after the association.
+	PhaseCheckIDSetup Phase = "checkid_setup"
+	// PhaseVerify is the verification of an assertion in IDRes.
+	PhaseVerify Phase = "verify"
+	// PhaseCheckAuthentication is the direct verification round-trip with
+	// the OpenID Server.
+	PhaseCheckAuthentication Phase = "check_authentication"
+)
+
+// PhaseError is the error of a phase cut short by the context of the
+// operation, like its deadline.
+type PhaseError struct {
+	Phase    Phase
+	Endpoint string
+	Err      error
+}
+
+// Error return the phase, the endpoint and the error.
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Phase, e.Endpoint, e.Err)
+}
+
+// Unwrap return the error.
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// Observer is notified of each phase with the endpoint, the time it took
+// and its error, if any. It must be safe for concurrent use.
+type Observer interface {
+	Observe(phase Phase, endpoint string, d time.Duration, err error)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(phase Phase, endpoint string, d time.Duration, err error)
+
+// Observe call f(phase, endpoint, d, err).
+func (f ObserverFunc) Observe(
+	phase Phase, endpoint string, d time.Duration, err error) {
+	f(phase, endpoint, d, err)
+}
+
+// SetObserver set the Observer notified of association and verification
+// timings, to attribute login latency.
+func (o *OpenID) SetObserver(observer Observer) {
+	o.observer = observer
+}
+
+// observe notify the Observer of phase started at start
+func (o *OpenID) observe(
+	phase Phase, endpoint string, start time.Time, err error) {
+
+	if o.observer != nil {
+		o.observer.Observe(phase, endpoint, time.Since(start), err)
+	}
+}
@@ -0,0 +1,60 @@
+package openid
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_SetObserver(t *testing.T) {
+	ts := newFakeProvider(t)
+
+	var mu sync.Mutex
+	timings := make(map[Phase]time.Duration)
+
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+	o.SetObserver(ObserverFunc(
+		func(phase Phase, endpoint string, d time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				t.Errorf("%s %s: %v", phase, endpoint, err)
+			}
+			if endpoint != ts.URL {
+				t.Errorf("%s endpoint %q, want %q", phase, endpoint, ts.URL)
+			}
+			timings[phase] += d
+		}))
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := timings[PhaseAssociate]; !ok {
+		t.Errorf("association round-trip not observed")
+	}
+	if timings[PhaseAssociate] <= 0 {
+		t.Errorf("association took %v", timings[PhaseAssociate])
+	}
+
+	delete(timings, PhaseAssociate)
+
+	// cached association is not a round-trip
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := timings[PhaseAssociate]; ok {
+		t.Errorf("cached association observed")
+	}
+	if _, ok := timings[PhaseAssociateCached]; !ok {
+		t.Errorf("cached association not observed")
+	}
+
+	if _, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := timings[PhaseVerify]; !ok {
+		t.Errorf("verification not observed")
+	}
+}
@@ -26,12 +26,15 @@ verify OpenID Server redirect back:
 package openid
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -45,135 +48,1099 @@ const (
 	Identity = "http://specs.openid.net/auth/2.0/identifier_select"
 	// NSSreg openid.ns.sreg
 	NSSreg = "http://openid.net/extensions/sreg/1.1"
+	// NSAX openid.ns.ax
+	NSAX = "http://openid.net/srv/ax/1.0"
 )
 
 // OpenID implementation
 type OpenID struct {
-	assocType string
-	realm     string
-	assocs    *associations
+	assocPrefs []AssocPreference
+	realm      string
+	assocs     AssociationStore
+	// allowed holds the allowed endpoints, nil means allow all.
+	allowed map[string]bool
+	// sregRequired and sregOptional are the sreg fields requested.
+	sregRequired, sregOptional []string
+	// sregAliases holds per endpoint sreg field aliases.
+	sregAliases map[string]map[string]string
+	// decodeTwice holds the endpoints double-encoding extension values.
+	decodeTwice map[string]bool
+	// nicknameFallback fills a missing sreg.nickname with sreg.fullname.
+	nicknameFallback bool
+	// axAttributes are the AX attributes requested in CheckIDSetup.
+	axAttributes []axAttribute
+	// maxAXAttributes limits the AX attributes requested, zero for none.
+	maxAXAttributes int
+	// axLimitPolicy is what to do with the AX attributes beyond the limit.
+	axLimitPolicy AXLimitPolicy
+	// emailCanonicalization derives canonical_email from the email.
+	emailCanonicalization EmailCanonicalization
+	// parallelDiscovery runs the discovery methods concurrently.
+	parallelDiscovery bool
+	// discoveryTimeout bounds each discovery, zero for none.
+	discoveryTimeout time.Duration
+	// stateless disables association with OpenID Servers.
+	stateless bool
+	// rand is the source of randomness for crypto operations.
+	rand io.Reader
+	// versions holds per endpoint protocol versions.
+	versions map[string]ProtocolVersion
+	// discoveredVersions holds the protocol versions detected by Discover.
+	discoveredVersions *lruCache
+	// pinEndpoints rejects claimed_id asserted by another endpoint.
+	pinEndpoints bool
+	// claimedEndpoints holds the endpoint first asserted each claimed_id,
+	// after discovery confirmed it.
+	claimedEndpoints *lruCache
+	// surfaceUnsigned keeps unsigned extension values apart in Assertion.
+	surfaceUnsigned bool
+	// client makes the requests to OpenID Servers.
+	client *http.Client
+	// strictHostname checks endpoint certificates against the endpoint host.
+	strictHostname bool
+	// pins holds per endpoint pinned certificate hashes.
+	pins map[string][]string
+	// keys signs tokens.
+	keys *KeyRing
+	// maxURLLength is the checkid_setup url length warned about.
+	maxURLLength int
+	// postLongURL posts checkid_setup urls longer than maxURLLength.
+	postLongURL bool
+	// identityTransform derives the subject from the claimed_id.
+	identityTransform func(claimedID string) string
+	// identityAllow holds the claimed_id patterns allowed, empty for all.
+	identityAllow []string
+	// identityDeny holds the claimed_id patterns denied.
+	identityDeny []string
+	// httpsIdentity rejects claimed_ids which are not https urls.
+	httpsIdentity bool
+	// observer is notified of phase timings.
+	observer Observer
+	// minAssocType is the weakest association type accepted by IDRes,
+	// empty for all.
+	minAssocType string
+	// assocGrace keeps expired associations usable in IDRes a bit longer.
+	assocGrace time.Duration
+	// returnToSchemes holds custom return_to schemes exempt from the realm.
+	returnToSchemes map[string]bool
+	// assocEpochCheck rejects assertions older than their association.
+	assocEpochCheck bool
+	// assocEpochSkew tolerates clock skew in assocEpochCheck.
+	assocEpochSkew time.Duration
+	// signRequests signs the checkid_setup requests.
+	signRequests bool
+	// callbackOrigin is the scheme and host of callbacks, nil not to check
+	// the origin of the return_to.
+	callbackOrigin *url.URL
+	// now is the clock of association expiry and nonce windows.
+	now func() time.Time
+	// nonces records the response_nonce already seen, nil disables replay
+	// protection.
+	nonces NonceStore
+	// discoveries holds the claimed identifiers discovered at login.
+	discoveries *lruCache
+	// endpoints holds the OpenID Server endpoints logged in with, the only
+	// ones but the allowed endpoints asked to verify assertions directly.
+	endpoints *lruCache
+	// nonceWindow is how old a response_nonce might be.
+	nonceWindow time.Duration
+	// nonceFailure is what to do when the NonceStore fails.
+	nonceFailure NonceFailurePolicy
 }
 
-// New openid, realm is local site, like https://localhost
-func New(realm string) *OpenID {
+// defaultSRegRequired are the sreg fields required by default
+var defaultSRegRequired = []string{"nickname", "email", "fullname"}
+
+// sregFields are the fields of Simple Registration 1.1
+var sregFields = map[string]bool{
+	"nickname": true, "email": true, "fullname": true, "dob": true,
+	"gender": true, "postcode": true, "country": true, "language": true,
+	"timezone": true,
+}
+
+// New openid, realm is local site, like https://localhost. store is an
+// optional AssociationStore shared by several instances, associations are
+// kept in memory by default.
+func New(realm string, store ...AssociationStore) *OpenID {
 
 	openid := &OpenID{
-		assocType: hmacSHA256,
-		realm:     realm,
-		assocs:    &associations{},
+		assocPrefs:   defaultAssocPreferences,
+		sregRequired: defaultSRegRequired,
+		realm:        realm,
+		assocs:       &associations{},
+		rand:         rand.Reader,
+		client:       http.DefaultClient,
+		now:          time.Now,
+
+		nonceWindow:     defaultNonceWindow,
+		maxAXAttributes: defaultMaxAXAttributes,
+		discoveries:     newLRUCache(discoveryCacheSize),
+		endpoints:       newLRUCache(knownEndpointsSize),
+
+		claimedEndpoints:   newLRUCache(pinnedClaimedIDsSize),
+		discoveredVersions: newLRUCache(knownEndpointsSize),
 	}
 
+	if len(store) > 0 && store[0] != nil {
+		openid.assocs = store[0]
+	}
+	openid.SetNonceStore(
+		NewMemoryNonceStore(defaultNonceWindow, defaultNonceStoreSize))
+
 	return openid
 }
 
+// SetAssocType set the only association type requested from OpenID
+// Servers, HMAC-SHA256 or HMAC-SHA1, with the matching Diffie-Hellman session
+// or no-encryption over https.
+func (o *OpenID) SetAssocType(assocType string) error {
+	sessionType := dhSHA256
+	if assocType == hmacSHA1 {
+		sessionType = dhSHA1
+	}
+
+	return o.SetAssocPreferences(
+		AssocPreference{AssocType: assocType, SessionType: sessionType},
+		AssocPreference{AssocType: assocType, SessionType: noEncryption})
+}
+
+// SetAssocPreferences set the association and session types to try, in
+// order of preference, until an OpenID Server accepts one. no-encryption
+// sessions are only tried with https endpoints.
+func (o *OpenID) SetAssocPreferences(prefs ...AssocPreference) error {
+	if len(prefs) == 0 {
+		return fmt.Errorf("no association preference")
+	}
+
+	for _, pref := range prefs {
+		if err := pref.check(); err != nil {
+			return err
+		}
+	}
+
+	o.assocPrefs = append([]AssocPreference(nil), prefs...)
+	return nil
+}
+
+// SetAllowedEndpoints restrict the OpenID Server endpoints to associate with
+// or accept assertions from. No endpoints means allow all, which is the
+// default.
+func (o *OpenID) SetAllowedEndpoints(endpoints ...string) {
+	if len(endpoints) == 0 {
+		o.allowed = nil
+		return
+	}
+
+	o.allowed = make(map[string]bool, len(endpoints))
+	for _, e := range endpoints {
+		o.allowed[strings.TrimRight(e, "/")] = true
+	}
+}
+
+// SetRandReader set the source of randomness used by crypto operations,
+// crypto/rand.Reader by default.
+func (o *OpenID) SetRandReader(r io.Reader) {
+	o.rand = r
+}
+
+// randomBytes read n random bytes from the source of randomness
+func (o *OpenID) randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(o.rand, b); err != nil {
+		return nil, fmt.Errorf("read random bytes failed: %w", err)
+	}
+	return b, nil
+}
+
+// SetMaxURLLength warn when the checkid_setup url exceeds n bytes, zero
+// disables the check. With post, RedirectToLogin sends such requests as a
+// self-submitting form posted to the OpenID Server instead of a redirect.
+func (o *OpenID) SetMaxURLLength(n int, post bool) {
+	o.maxURLLength = n
+	o.postLongURL = post && n > 0
+}
+
+// SetStateless disable association in CheckIDSetup, no assoc_handle is sent
+// and the OpenID Server has to be asked to verify the assertion directly.
+// Only the endpoints logged in with by this instance are asked, set the
+// allowed endpoints when another instance handles the callback.
+func (o *OpenID) SetStateless(stateless bool) {
+	o.stateless = stateless
+}
+
+// SetRequestSigning enable signing the checkid_setup requests with the
+// association, for the OpenID Servers demanding it. The mode, assoc_handle,
+// return_to, realm or trust_root, claimed_id and identity are signed, like
+// in a positive assertion, listed in openid.signed with the signature in
+// openid.sig. It fails in stateless mode.
+func (o *OpenID) SetRequestSigning(enabled bool) {
+	o.signRequests = enabled
+}
+
+// SetProtocolVersion set the OpenID protocol version supported by endpoint,
+// as detected by discovery. OpenID 2.0 is assumed by default.
+func (o *OpenID) SetProtocolVersion(endpoint string, version ProtocolVersion) {
+	if o.versions == nil {
+		o.versions = make(map[string]ProtocolVersion)
+	}
+	o.versions[strings.TrimRight(endpoint, "/")] = version
+}
+
+// EndpointVersion return the OpenID protocol version supported by endpoint,
+// set by SetProtocolVersion or else detected by Discover
+func (o *OpenID) EndpointVersion(endpoint string) ProtocolVersion {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if version, ok := o.versions[endpoint]; ok {
+		return version
+	}
+	if version, ok := o.discoveredVersions.get(endpoint); ok {
+		return version.(ProtocolVersion)
+	}
+	return Version20
+}
+
+// pinnedClaimedIDsSize is how many claimed_id are pinned to their endpoint,
+// the least recently asserted ones are forgotten beyond
+const pinnedClaimedIDsSize = 100000
+
+// SetEndpointPinning reject assertions for a claimed_id coming from another
+// endpoint than the one which first asserted it, once discovery confirmed
+// that one serves it. The most recently asserted claimed_id are pinned, in
+// memory. Disabled by default.
+func (o *OpenID) SetEndpointPinning(pin bool) {
+	o.pinEndpoints = pin
+}
+
+// checkEndpointPinning check endpoint is the one pinned for claimedID
+func (o *OpenID) checkEndpointPinning(claimedID, endpoint string) error {
+	if !o.pinEndpoints || claimedID == "" {
+		return nil
+	}
+
+	endpoint = strings.TrimRight(endpoint, "/")
+	pinned, _ := o.claimedEndpoints.getOrAdd(claimedID, endpoint)
+	if pinned.(string) != endpoint {
+		return fmt.Errorf("%w: %s asserted by %s, pinned to %s",
+			ErrEndpointChanged, claimedID, endpoint, pinned)
+	}
+	return nil
+}
+
+// SetUnsignedExtensions surface the values the OpenID Server did not sign,
+// like sreg or ax fields, in Assertion.Unsigned. They are dropped by
+// default and never returned with the signed values.
+func (o *OpenID) SetUnsignedExtensions(surface bool) {
+	o.surfaceUnsigned = surface
+}
+
+// SetIdentityTransform derive a stable identifier from the verified
+// claimed_id, like a normalized or hashed form, returned as "subject" in
+// the user values.
+func (o *OpenID) SetIdentityTransform(transform func(claimedID string) string) {
+	o.identityTransform = transform
+}
+
+// SetAssocGracePeriod accept assertions in IDRes whose association expired
+// within grace, the signature is still valid as the OpenID Server signed it
+// before expiration. CheckIDSetup never uses expired associations.
+func (o *OpenID) SetAssocGracePeriod(grace time.Duration) {
+	o.assocGrace = grace
+}
+
+// SetAssociationEpochCheck reject assertions whose response_nonce time is
+// before the creation of the association they are signed with, tolerating
+// skew between the clocks of the Consumer and the OpenID Server.
+func (o *OpenID) SetAssociationEpochCheck(enabled bool, skew time.Duration) {
+	o.assocEpochCheck = enabled
+	o.assocEpochSkew = skew
+}
+
+// checkAssociationEpoch check the response_nonce of user is not before the
+// creation of assoc
+func (o *OpenID) checkAssociationEpoch(
+	assoc *Association, user map[string]string) error {
+
+	if assoc.Created.IsZero() {
+		return nil
+	}
+
+	nonce, ok := user["response_nonce"]
+	if !ok {
+		return fmt.Errorf("%w: no response_nonce",
+			ErrAssertionBeforeAssociation)
+	}
+
+	issued, err := parseNonceTime(nonce)
+	if err != nil {
+		return err
+	}
+
+	if issued.Before(assoc.Created.Add(-o.assocEpochSkew)) {
+		return fmt.Errorf("%w: issued %s, association created %s",
+			ErrAssertionBeforeAssociation, issued, assoc.Created)
+	}
+	return nil
+}
+
+// SetAssociationStore set the store of associations, in memory by default.
+func (o *OpenID) SetAssociationStore(store AssociationStore) {
+	o.assocs = store
+}
+
+// association get the Association of endpoint, which has not expired for
+// longer than grace. Associations expired for longer are deleted.
+func (o *OpenID) association(
+	endpoint string, grace time.Duration) (*Association, bool) {
+
+	assoc, ok := o.assocs.Get(endpoint)
+	if !ok {
+		return nil, false
+	}
+
+	now := o.now()
+	if assoc.Expires.After(now) {
+		return &assoc, true
+	}
+
+	if assoc.Expires.Add(o.assocGrace).Before(now) {
+		o.assocs.Delete(endpoint)
+	}
+	if assoc.Expires.Add(grace).After(now) {
+		return &assoc, true
+	}
+	return nil, false
+}
+
+// SetSRegFields set the sreg fields requested in CheckIDSetup, required
+// ones or optional ones the OpenID Server may omit. Nickname, email and
+// fullname are required by default.
+func (o *OpenID) SetSRegFields(required, optional []string) error {
+	for _, fields := range [][]string{required, optional} {
+		for _, field := range fields {
+			if !sregFields[field] {
+				return fmt.Errorf("unknown sreg field %q", field)
+			}
+		}
+	}
+
+	o.sregRequired = append([]string(nil), required...)
+	o.sregOptional = append([]string(nil), optional...)
+	return nil
+}
+
+// SetSRegAliases normalize sreg fields returned by endpoint, aliases map
+// the field name used by the OpenID Server to the canonical sreg field name,
+// like {"emailaddress": "email"}.
+func (o *OpenID) SetSRegAliases(endpoint string, aliases map[string]string) {
+	if o.sregAliases == nil {
+		o.sregAliases = make(map[string]map[string]string)
+	}
+	o.sregAliases[strings.TrimRight(endpoint, "/")] = aliases
+}
+
+// SetDecodeTwice decode the sreg and AX values returned by endpoint once
+// more, for OpenID Servers which url-encode them twice. Disabled by default.
+func (o *OpenID) SetDecodeTwice(endpoint string, enabled bool) {
+	if o.decodeTwice == nil {
+		o.decodeTwice = make(map[string]bool)
+	}
+	o.decodeTwice[strings.TrimRight(endpoint, "/")] = enabled
+}
+
+// SetNicknameFallback fill a missing sreg.nickname with the sreg.fullname
+// returned by the OpenID Server, disabled by default.
+func (o *OpenID) SetNicknameFallback(enabled bool) {
+	o.nicknameFallback = enabled
+}
+
+// normalizeSReg rename aliased sreg fields of user to canonical names, and
+// fill the nickname fallback
+func (o *OpenID) normalizeSReg(endpoint string, user map[string]string) {
+	aliases := o.sregAliases[strings.TrimRight(endpoint, "/")]
+	for alias, field := range aliases {
+		v, ok := user["sreg."+alias]
+		if !ok {
+			continue
+		}
+		delete(user, "sreg."+alias)
+		if _, ok := user["sreg."+field]; !ok {
+			user["sreg."+field] = v
+		}
+	}
+
+	if _, ok := user["sreg.nickname"]; !ok && o.nicknameFallback {
+		if fullname, ok := user["sreg.fullname"]; ok {
+			user["sreg.nickname"] = fullname
+		}
+	}
+}
+
+// decodeExtensions decode the sreg and AX values of user once more if
+// endpoint double-encodes them. Values which are not valid encodings are
+// kept as is.
+func (o *OpenID) decodeExtensions(endpoint string, user map[string]string) {
+	if !o.decodeTwice[strings.TrimRight(endpoint, "/")] {
+		return
+	}
+
+	prefixes := []string{"sreg."}
+	if ax, ok := axAlias(user); ok {
+		prefixes = append(prefixes, ax+".value.")
+	}
+
+	for k, v := range user {
+		for _, prefix := range prefixes {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if decoded, err := url.QueryUnescape(v); err == nil {
+				user[k] = decoded
+			}
+		}
+	}
+}
+
+// endpointAllowed check endpoint against the allowed endpoints
+func (o *OpenID) endpointAllowed(endpoint string) bool {
+	return o.allowed == nil || o.allowed[strings.TrimRight(endpoint, "/")]
+}
+
+// endpointKnown report whether endpoint is one the Consumer trusts to
+// verify assertions directly: an allowed endpoint, one associated with or
+// one logged in with, rather than any url named by an assertion.
+func (o *OpenID) endpointKnown(endpoint string) bool {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if o.allowed != nil {
+		return o.allowed[endpoint]
+	}
+	if _, ok := o.assocs.Get(endpoint); ok {
+		return true
+	}
+	_, ok := o.endpoints.get(endpoint)
+	return ok
+}
+
 // CheckIDSetup build redirect url for User Agent. endport is OpenID Server
 // endpoint, like https://openidprovider.com/openid; callbackPrefix is Consumer
-// urlPrefix which handle the OpenID Server back redirection.
+// urlPrefix which handle the OpenID Server back redirection, or an absolute
+// return_to under the realm or with a scheme set by SetReturnToSchemes.
 func (o *OpenID) CheckIDSetup(
 	endpoint string, callbackPrefix string, optional ...string) (string, error) {
-	required := "nickname,email,fullname"
+	return o.CheckIDSetupContext(
+		context.Background(), endpoint, callbackPrefix, optional...)
+}
+
+// CheckIDSetupContext is CheckIDSetup with ctx bounding the whole
+// operation, the association with the OpenID Server and the building of the
+// url. An expired ctx is reported as a *PhaseError of the phase it cut short.
+func (o *OpenID) CheckIDSetupContext(ctx context.Context,
+	endpoint string, callbackPrefix string, optional ...string) (string, error) {
+
+	return o.checkIDSetup(ctx, &discovered{
+		endpoint:  endpoint,
+		claimedID: ClaimedID,
+		localID:   Identity,
+		version:   o.EndpointVersion(endpoint),
+	}, "checkid_setup", callbackPrefix, optional...)
+}
+
+// CheckIDImmediate build redirect url for User Agent like CheckIDSetup, but
+// the OpenID Server answers at once without interacting with the user, for
+// silent re-authentication. When the user has to log in first, IDResAssertion
+// returns an Assertion with SetupNeeded, then use CheckIDSetup.
+func (o *OpenID) CheckIDImmediate(
+	endpoint string, callbackPrefix string, optional ...string) (string, error) {
+
+	return o.checkIDSetup(context.Background(), &discovered{
+		endpoint:  endpoint,
+		claimedID: ClaimedID,
+		localID:   Identity,
+		version:   o.EndpointVersion(endpoint),
+	}, "checkid_immediate", callbackPrefix, optional...)
+}
+
+// checkIDSetup build the redirect url for User Agent to the discovered
+// OpenID Server, mode is checkid_setup or checkid_immediate
+func (o *OpenID) checkIDSetup(ctx context.Context,
+	d *discovered, mode, callbackPrefix string,
+	optional ...string) (urlStr string, err error) {
+
+	required := strings.Join(o.sregRequired, ",")
+	endpoint := d.endpoint
 
 	if len(optional) > 0 {
 		required = optional[0]
 	}
 
-	assoc := o.associate(endpoint)
-	if assoc == nil {
-		return "", fmt.Errorf("associate with OpenID Server failed")
+	if !o.endpointAllowed(endpoint) {
+		return "", fmt.Errorf("%w: %s", ErrEndpointNotAllowed, endpoint)
+	}
+	if d.version == Version11 && d.localID == Identity {
+		return "", fmt.Errorf("OpenID 1.1 endpoint %s has no identifier "+
+			"selection, log in with CheckIDSetupIdentifier", endpoint)
+	}
+	o.endpoints.add(strings.TrimRight(endpoint, "/"), struct{}{})
+
+	var assoc *Association
+	if !o.stateless {
+		if assoc, err = o.associate(ctx, endpoint, false); err != nil {
+			if ctx.Err() != nil {
+				err = &PhaseError{Phase: PhaseAssociate, Endpoint: endpoint, Err: err}
+			}
+			return "", err
+		}
+	}
+
+	start := time.Now()
+	defer func() { o.observe(PhaseCheckIDSetup, endpoint, start, err) }()
+
+	o.rememberDiscovered(d)
+
+	returnTo := ExpectedReturnTo(o.realm, callbackPrefix)
+	if err := o.checkReturnTo(returnTo); err != nil {
+		return "", err
+	}
+	if len(d.returnTo) > 0 && !containsString(d.returnTo, returnTo) {
+		log.Printf("return_to %s is not registered with %s, only %s",
+			returnTo, endpoint, strings.Join(d.returnTo, ", "))
 	}
 
 	values := map[string]string{
-		"mode":          "checkid_setup",
+		"mode":          mode,
 		"ns":            Namespace,
-		"assoc_handle":  assoc.Handle,
 		"realm":         o.realm,
-		"return_to":     fmt.Sprintf("%s%s", o.realm, callbackPrefix),
-		"claimed_id":    ClaimedID,
-		"identity":      Identity,
+		"return_to":     returnTo,
+		"claimed_id":    d.claimedID,
+		"identity":      d.localID,
 		"ns.sreg":       NSSreg,
 		"sreg.required": required,
 	}
 
+	if len(o.sregOptional) > 0 {
+		values["sreg.optional"] = strings.Join(o.sregOptional, ",")
+	}
+	if required == "" {
+		delete(values, "sreg.required")
+	}
+
+	if err := o.axRequest(values); err != nil {
+		return "", err
+	}
+
+	if d.version == Version11 {
+		// OpenID 1.1 has neither namespaces, claimed_id nor realm, the
+		// return_to tells the claimed_id and endpoint of the assertion
+		nonce, err := o.newNonce()
+		if err != nil {
+			return "", err
+		}
+		if values["return_to"], err = openID1ReturnTo(returnTo, d, nonce); err != nil {
+			return "", err
+		}
+		values["trust_root"] = values["realm"]
+		delete(values, "realm")
+		delete(values, "ns")
+		delete(values, "ns.sreg")
+		delete(values, "claimed_id")
+		for k := range values {
+			if k == "ns.ax" || strings.HasPrefix(k, "ax.") {
+				delete(values, k)
+			}
+		}
+	}
+
+	// never send an empty assoc_handle, which confuses OpenID Servers
+	if assoc != nil && assoc.Handle != "" {
+		values["assoc_handle"] = assoc.Handle
+	}
+
+	if o.signRequests {
+		if assoc == nil {
+			return "", fmt.Errorf("%w: request signing requires one",
+				ErrNoAssociation)
+		}
+		if err := signRequest(assoc, values); err != nil {
+			return "", err
+		}
+	}
+
 	v := url.Values{}
 	encodeHTTP(v, values)
 
-	urlStr := fmt.Sprintf("%s?%s", endpoint, v.Encode())
+	urlStr = fmt.Sprintf("%s?%s", endpoint, v.Encode())
+	if o.maxURLLength > 0 && len(urlStr) > o.maxURLLength {
+		log.Printf("checkid_setup url of %d bytes exceeds %d bytes",
+			len(urlStr), o.maxURLLength)
+	}
+
+	// the deadline bounds the whole operation, not only the round-trips
+	if err := ctx.Err(); err != nil {
+		return "", &PhaseError{Phase: PhaseCheckIDSetup, Endpoint: endpoint, Err: err}
+	}
 	return urlStr, nil
 }
 
-// IDRes handle the OpenID Server back redirection
+// RedirectToLogin redirect the User Agent to the OpenID Server login url
+// built by CheckIDSetup. Urls exceeding the SetMaxURLLength limit are sent
+// as a self-submitting form if so configured. On failure an error status is
+// written and the error returned.
+func (o *OpenID) RedirectToLogin(rw http.ResponseWriter, r *http.Request,
+	endpoint string, callbackPrefix string) error {
+
+	urlStr, err := o.CheckIDSetupContext(r.Context(), endpoint, callbackPrefix)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrEndpointNotAllowed) {
+			status = http.StatusForbidden
+		}
+		http.Error(rw, http.StatusText(status), status)
+		return err
+	}
+
+	if o.postLongURL && len(urlStr) > o.maxURLLength {
+		return writeForm(rw, urlStr)
+	}
+
+	http.Redirect(rw, r, urlStr, http.StatusFound)
+	return nil
+}
+
+// ExpectedReturnTo build the return_to url from realm and callbackPrefix.
+// It is the single source of truth for the return_to sent in CheckIDSetup
+// and expected back in IDRes. An absolute callbackPrefix, like the deep link
+// myapp://auth of a mobile app, is the return_to itself. realm and
+// callbackPrefix are joined with a single slash, whichever of them has one.
+func ExpectedReturnTo(realm, callbackPrefix string) string {
+	if u, err := url.Parse(callbackPrefix); err == nil && u.IsAbs() {
+		return callbackPrefix
+	}
+	if callbackPrefix == "" {
+		return realm
+	}
+	return fmt.Sprintf("%s/%s",
+		strings.TrimRight(realm, "/"), strings.TrimLeft(callbackPrefix, "/"))
+}
+
+// IsCallback report whether r is an OpenID Server back redirection, with
+// openid.mode id_res, cancel or error.
+func IsCallback(r *http.Request) bool {
+	values, err := callbackValues(r)
+	if err != nil {
+		return false
+	}
+
+	switch parseHTTP(values)["mode"] {
+	case "id_res", "setup_needed", "cancel", "error":
+		return true
+	default:
+		return false
+	}
+}
+
+// IDRes handle the OpenID Server back redirection, or the POST callback of
+// large assertions. Assertions not signed with a known association are
+// verified with the OpenID Server directly, within the context of r. Only
+// the allowed endpoints, and those associated or logged in with, are asked.
+// The claimed_id must be discovered to be served by the asserting endpoint.
+// The setup_needed answer to CheckIDImmediate is returned as ErrSetupNeeded.
 func (o *OpenID) IDRes(r *http.Request) (map[string]string, error) {
+	assertion, err := o.IDResAssertion(r)
+	if err != nil {
+		return nil, err
+	}
+	if assertion.SetupNeeded {
+		return nil, ErrSetupNeeded
+	}
+	return assertion.Values, nil
+}
+
+// IDResAssertion handle the OpenID Server back redirection like IDRes,
+// returning the whole verified Assertion. The setup_needed answer to
+// CheckIDImmediate is not an error but an Assertion with SetupNeeded.
+func (o *OpenID) IDResAssertion(r *http.Request) (a *Assertion, err error) {
+	start := time.Now()
 
-	user := parseHTTP(r.URL.Query())
+	values, err := callbackValues(r)
+	if err != nil {
+		return nil, err
+	}
+
+	user := parseHTTP(values)
 	endpoint := user["op_endpoint"]
+	if isOpenID1(user) {
+		endpoint = openID1Param(user["return_to"], openID1Endpoint)
+	}
 
-	assocs, ok := o.assocs.get(endpoint)
-	if !ok {
-		return nil, fmt.Errorf("no Association found for %s", endpoint)
+	defer func() { o.observe(PhaseVerify, endpoint, start, err) }()
+
+	// only id_res assertions are signed
+	switch user["mode"] {
+	case "cancel":
+		return nil, cancelError(user)
+	case "error":
+		return nil, fmt.Errorf("%w: %q", ErrProviderError, user["error"])
+	case "setup_needed":
+		return &Assertion{SetupNeeded: true}, nil
+	case "id_res":
+		// OpenID 1.1 answers id_res with the user_setup_url instead
+		if setupURL := user["user_setup_url"]; setupURL != "" {
+			return &Assertion{SetupNeeded: true, UserSetupURL: setupURL}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected openid.mode %q", user["mode"])
+	}
+
+	if !o.endpointAllowed(endpoint) {
+		return nil, fmt.Errorf("%w: %s", ErrEndpointNotAllowed, endpoint)
+	}
+
+	// without an association for the handle of the assertion, like in
+	// stateless mode, the OpenID Server has to verify it directly. So does
+	// it when the OpenID Server no longer knows the handle we sent, named by
+	// invalidate_handle, and signed with a fresh one.
+	method := VerifiedViaAssociation
+	assocs, ok := o.association(endpoint, o.assocGrace)
+	invalidate := user["invalidate_handle"]
+	if !ok || assocs.Handle != user["assoc_handle"] || invalidate != "" {
+		if err := o.checkAuthentication(r.Context(), endpoint, user); err != nil {
+			return nil, &kindError{kind: ErrNoAssociation, err: err}
+		}
+		if ok && assocs.Handle == invalidate {
+			o.assocs.Delete(endpoint)
+		}
+		method, assocs = VerifiedViaDirect, nil
+	} else {
+		valid, err := VerifySignature(*assocs, user)
+		if err != nil {
+			return nil, err
+		}
+
+		// the OpenID Server might have changed the secret of the handle,
+		// ask it before failing and drop our stale association
+		if !valid {
+			if err := o.checkAuthentication(r.Context(), endpoint, user); err != nil {
+				return nil, &kindError{kind: ErrSignatureMismatch, err: err}
+			}
+			o.assocs.Delete(endpoint)
+			method, assocs = VerifiedViaDirect, nil
+		}
+	}
+
+	if err := o.checkAssocType(assocs, user); err != nil {
+		return nil, err
+	}
+
+	// an unsigned response_nonce could be changed freely to defeat replay
+	// protection
+	_, hasNonce := user["response_nonce"]
+	if !hasNonce && !isOpenID1(user) {
+		return nil, ErrNonceMissing
+	}
+	if hasNonce && !signedFields(user)["response_nonce"] {
+		return nil, ErrNonceNotSigned
+	}
+
+	if err := checkRequiredSigned(user); err != nil {
+		return nil, err
+	}
+
+	if err := o.checkReturnTo(user["return_to"]); err != nil {
+		return nil, err
+	}
+	if err := o.checkReturnToURL(user["return_to"], r); err != nil {
+		return nil, err
 	}
 
-	signed, err := assocs.sign(user, strings.Split(user["signed"], ","))
+	if o.assocEpochCheck && assocs != nil {
+		if err := o.checkAssociationEpoch(assocs, user); err != nil {
+			return nil, err
+		}
+	}
+
+	unsigned := dropUnsigned(user)
+	if !o.surfaceUnsigned {
+		unsigned = nil
+	}
+
+	if isOpenID1(user) {
+		if err := openID1Values(user, endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.nonces != nil {
+		if err := o.checkNonce(endpoint, user["response_nonce"]); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := o.verifyDiscovered(r.Context(), endpoint, user)
 	if err != nil {
 		return nil, err
-	} else if signed != user["sig"] {
-		return nil, fmt.Errorf("verify singed failed %s", endpoint)
 	}
 
-	return user, nil
+	if err := o.checkEndpointPinning(user["claimed_id"], endpoint); err != nil {
+		return nil, err
+	}
+
+	if err := o.checkIdentity(user["claimed_id"]); err != nil {
+		return nil, err
+	}
+
+	o.decodeExtensions(endpoint, user)
+	o.normalizeSReg(endpoint, user)
+
+	ax, err := parseAX(user)
+	if err != nil {
+		return nil, err
+	}
+	o.axFriendly(user, ax)
+
+	if o.emailCanonicalization != EmailRaw {
+		if addr, ok := email(user, ax); ok {
+			user["canonical_email"] = canonicalEmail(addr, o.emailCanonicalization)
+		}
+	}
+
+	if o.identityTransform != nil {
+		user["subject"] = o.identityTransform(user["claimed_id"])
+	}
+
+	return &Assertion{
+		Values:            user,
+		Unsigned:          unsigned,
+		AX:                ax,
+		Method:            method,
+		DisplayIdentifier: displayIdentifier(d, user),
+	}, nil
+}
+
+// Reassociate with OpenID Server, bypassing and replacing any cached
+// association of endpoint, like when its handle might be compromised.
+func (o *OpenID) Reassociate(endpoint string) error {
+	_, err := o.associate(context.Background(), endpoint, true)
+	return err
 }
 
 // associate with OpenID Server. endpoint is OpenID endpoint, like
-// https://openidserver.com/openid
-func (o *OpenID) associate(endpoint string) *Association {
+// https://openidserver.com/openid. force bypasses the cached association.
+func (o *OpenID) associate(ctx context.Context,
+	endpoint string, force bool) (a *Association, err error) {
+
+	if !o.endpointAllowed(endpoint) {
+		return nil, fmt.Errorf("%w: %s", ErrEndpointNotAllowed, endpoint)
+	}
+
+	if assoc, ok := o.association(endpoint, 0); ok && !force {
+		o.observe(PhaseAssociateCached, endpoint, time.Now(), nil)
+		return assoc, nil
+	}
+
+	start := time.Now()
+	defer func() { o.observe(PhaseAssociate, endpoint, start, err) }()
+
+	client, err := o.httpClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// walk the preferences until the OpenID Server accepts one, the secret
+	// is only sent in the clear over https
+	var assoc *Association
+	err = fmt.Errorf("no-encryption association requires https")
+	retried := false
+	for _, pref := range o.assocPrefs {
+		if pref.SessionType == noEncryption && !isHTTPS(endpoint) {
+			continue
+		}
+
+		assoc, err = o.requestAssociation(ctx, client, endpoint, pref)
+		var de *directError
+		if !errors.As(err, &de) {
+			break
+		}
+
+		// retry once with the types the OpenID Server suggests
+		if suggested, ok := de.suggestion(endpoint); ok && !retried {
+			retried = true
+			assoc, err = o.requestAssociation(ctx, client, endpoint, suggested)
+			if !errors.As(err, &de) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, &kindError{kind: ErrAssociateFailed, err: err}
+	}
+
+	// store associate for later use
+	o.assocs.Set(endpoint, *assoc)
+
+	return assoc, nil
+}
+
+// associationSecret get the secret of the associate response values,
+// decrypting it for the Diffie-Hellman session dh
+func associationSecret(endpoint string,
+	dh *dhSession, values map[string]string) ([]byte, error) {
+
+	sessionType := values["session_type"]
+	if sessionType == "" {
+		sessionType = noEncryption
+	}
+
+	if sessionType != noEncryption {
+		if dh == nil || sessionType != dh.sessionType {
+			return nil, fmt.Errorf("unexpected session type %q", sessionType)
+		}
+		return dh.secret(values["dh_server_public"], values["enc_mac_key"])
+	}
+
+	// the secret was sent in the clear
+	if !isHTTPS(endpoint) {
+		return nil, fmt.Errorf("no-encryption association requires https")
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(values["mac_key"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid mac_key: %w", err)
+	}
+	return secret, nil
+}
+
+// checkAssociationKeys ensure the associate response values have all the
+// mandatory keys of their session type
+func checkAssociationKeys(values map[string]string) error {
+	keys := []string{"assoc_handle", "assoc_type", "expires_in"}
+
+	switch values["session_type"] {
+	case "", noEncryption:
+		keys = append(keys, "mac_key")
+	default:
+		keys = append(keys, "dh_server_public", "enc_mac_key")
+	}
+
+	for _, k := range keys {
+		if values[k] == "" {
+			return fmt.Errorf("%w: missing %s", ErrIncompleteAssociation, k)
+		}
+	}
+	return nil
+}
+
+// containsString report whether ss contains s
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTPS report whether endpoint is an https url
+func isHTTPS(endpoint string) bool {
+	return strings.HasPrefix(strings.ToLower(endpoint), "https://")
+}
+
+// requestAssociation make a request to OpenID Server asking for associate
+// with the association and session types of pref
+func (o *OpenID) requestAssociation(ctx context.Context,
+	client *http.Client, endpoint string, pref AssocPreference) (*Association, error) {
+
 	values := map[string]string{
-		"mode":       "associate",
-		"assoc_type": o.assocType,
+		"mode":         "associate",
+		"assoc_type":   pref.AssocType,
+		"session_type": pref.SessionType,
 	}
 
-	if assoc, ok := o.assocs.get(endpoint); ok {
-		return assoc
+	var dh *dhSession
+	if pref.SessionType != noEncryption {
+		var err error
+		if dh, err = o.newDHSession(pref.SessionType); err != nil {
+			return nil, err
+		}
+		for k, dv := range dh.values() {
+			values[k] = dv
+		}
 	}
 
 	v := url.Values{}
 	encodeHTTP(v, values)
 	urlStr := fmt.Sprintf("%s?%s", endpoint, v.Encode())
-	// make a request to OpenID Server asking for associate
-	resp, err := http.Get(urlStr)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	a, err := o.associationResponse(endpoint, dh, resp)
+	return a, responseError(resp, err)
+}
+
+// associationResponse get the association of the associate response resp,
+// to a request with dh for Diffie-Hellman sessions
+func (o *OpenID) associationResponse(endpoint string,
+	dh *dhSession, resp *http.Response) (*Association, error) {
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	openidValues, err := parseKeyValue(body)
+
+	// a client error is final, except the unsupported-type error which lets
+	// us negotiate another association type
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		(err != nil || openidValues["error_code"] != "unsupported-type") {
+		return nil, fmt.Errorf("%w: %s: %q", ErrAssociateRejected,
+			resp.Status, strings.TrimSpace(string(body)))
+	}
+
 	if err != nil {
-		return nil
+		// Key-Value Form lines always end with a newline
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			return nil, fmt.Errorf("%w: %v", ErrIncompleteAssociation, err)
+		}
+		return nil, err
 	}
 
-	secret, err := base64.StdEncoding.DecodeString(openidValues["mac_key"])
+	if openidValues["error"] != "" {
+		return nil, &directError{values: openidValues}
+	}
+
+	if err := checkAssociationKeys(openidValues); err != nil {
+		return nil, err
+	}
+
+	secret, err := associationSecret(endpoint, dh, openidValues)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	expiresIn, err := strconv.Atoi(openidValues["expires_in"])
+	if err := checkSecret(openidValues["assoc_type"], secret); err != nil {
+		return nil, err
+	}
+
+	expiresDu, err := parseExpiresIn(openidValues["expires_in"])
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	expiresDu := time.Duration(expiresIn) * time.Second
 
-	assoc := &Association{
+	now := o.now()
+	return &Association{
 		Endpoint: endpoint,
 		Handle:   openidValues["assoc_handle"],
 		Secret:   secret,
 		Type:     openidValues["assoc_type"],
-		Expires:  time.Now().Add(expiresDu),
-	}
-
-	// store associate for later use
-	o.assocs.set(endpoint, assoc)
-
-	return assoc
+		Expires:  now.Add(expiresDu),
+		Created:  now,
+	}, nil
 }
@@ -0,0 +1,75 @@
+package openid
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// OpenID 1.1 assertions carry neither claimed_id, op_endpoint nor
+// response_nonce, so CheckIDSetup keeps them in the return_to, which the
+// OpenID Server signs.
+const (
+	openID1ClaimedID = "openid1_claimed_id"
+	openID1Endpoint  = "openid1_op_endpoint"
+	openID1Nonce     = "openid1_nonce"
+)
+
+// isOpenID1 report whether the assertion values are OpenID 1.1 ones, which
+// have no openid.ns
+func isOpenID1(values map[string]string) bool {
+	_, ok := values["ns"]
+	return !ok
+}
+
+// openID1ReturnTo add the claimed identifier and the endpoint of d, and
+// nonce, to returnTo, for the OpenID 1.1 assertion to tell them
+func openID1ReturnTo(returnTo string, d *discovered, nonce string) (string, error) {
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return "", fmt.Errorf("invalid return_to %q: %w", returnTo, err)
+	}
+
+	q := u.Query()
+	q.Set(openID1ClaimedID, d.claimedID)
+	q.Set(openID1Endpoint, d.endpoint)
+	q.Set(openID1Nonce, nonce)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// openID1Param get the parameter key of the return_to of an OpenID 1.1
+// assertion
+func openID1Param(returnTo, key string) string {
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get(key)
+}
+
+// openID1Values set the claimed_id, op_endpoint and response_nonce of the
+// verified OpenID 1.1 assertion values from their signed return_to. Unsigned
+// values are already dropped.
+func openID1Values(values map[string]string, endpoint string) error {
+	returnTo, ok := values["return_to"]
+	if !ok {
+		return fmt.Errorf("%w: OpenID 1.1 return_to not signed",
+			ErrReturnToMismatch)
+	}
+
+	claimedID := openID1Param(returnTo, openID1ClaimedID)
+	if claimedID == "" {
+		claimedID = values["identity"]
+	}
+	if claimedID != "" {
+		values["claimed_id"] = claimedID
+	}
+	values["op_endpoint"] = endpoint
+
+	nonce := openID1Param(returnTo, openID1Nonce)
+	if nonce == "" {
+		return ErrNonceMissing
+	}
+	values["response_nonce"] = nonce
+	return nil
+}
@@ -1,20 +1,1209 @@
 package openid
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var realm = "https://localhost"
 
 // var opEndpoint = "https://login.example.com/openid"
-// var callbackPrefix = "/openid/verify"
+var callbackPrefix = "/openid/verify"
+
+// fakeSecret is the mac_key handed out by the fake OpenID Server.
+var fakeSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// fakeProvider is a fake OpenID Server answering associate requests.
+var fakeProvider = http.HandlerFunc(
+	func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		assocType, secret := hmacSHA256, fakeSecret
+		if q.Get("openid.assoc_type") == hmacSHA1 {
+			assocType, secret = hmacSHA1, fakeSecret[:sha1.Size]
+		}
+		sessionType := q.Get("openid.session_type")
+
+		fmt.Fprintf(w, "ns:%s\n", Namespace)
+		fmt.Fprintf(w, "assoc_handle:%s\n", "fake-handle")
+		fmt.Fprintf(w, "assoc_type:%s\n", assocType)
+		fmt.Fprintf(w, "session_type:%s\n", sessionType)
+		fmt.Fprintf(w, "expires_in:%d\n", 3600)
+
+		if sessionType == noEncryption {
+			fmt.Fprintf(w, "mac_key:%s\n",
+				base64.StdEncoding.EncodeToString(secret))
+			return
+		}
+
+		serverPublic, encMacKey, err := fakeDHServer(q, sessionType, secret)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "dh_server_public:%s\n", serverPublic)
+		fmt.Fprintf(w, "enc_mac_key:%s\n", encMacKey)
+	})
+
+// fakeDHServer is the OpenID Server side of a Diffie-Hellman session,
+// encrypting secret for the Consumer of q.
+func fakeDHServer(q url.Values,
+	sessionType string, secret []byte) (string, string, error) {
+
+	newHash, err := dhHash(sessionType)
+	if err != nil {
+		return "", "", err
+	}
+
+	decode := func(key string) (*big.Int, error) {
+		b, err := base64.StdEncoding.DecodeString(q.Get(key))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid %s", key)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	p, err := decode("openid.dh_modulus")
+	if err != nil {
+		return "", "", err
+	}
+	g, err := decode("openid.dh_gen")
+	if err != nil {
+		return "", "", err
+	}
+	consumerPublic, err := decode("openid.dh_consumer_public")
+	if err != nil {
+		return "", "", err
+	}
+
+	private := big.NewInt(0x5eC2e7)
+	h := newHash()
+	h.Write(btwoc(new(big.Int).Exp(consumerPublic, private, p)))
+	key := h.Sum(nil)
+
+	enc := make([]byte, len(secret))
+	for i := range secret {
+		enc[i] = key[i] ^ secret[i]
+	}
+
+	return base64.StdEncoding.EncodeToString(btwoc(new(big.Int).Exp(g, private, p))),
+		base64.StdEncoding.EncodeToString(enc), nil
+}
+
+// newFakeProvider start a fake OpenID Server.
+func newFakeProvider(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(fakeProvider)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// newDirectServer start a https server answering every request with body
+func newDirectServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// fakeAssociation return an association matching the fake OpenID Server
+func fakeAssociation(endpoint string) *Association {
+	return &Association{
+		Endpoint: endpoint,
+		Handle:   "fake-handle",
+		Secret:   fakeSecret,
+		Type:     hmacSHA256,
+		Expires:  time.Now().Add(time.Hour),
+	}
+}
+
+// serveDiscovery make every claimed identifier outside the local test
+// servers discover endpoint, through the client of o
+func serveDiscovery(o *OpenID, endpoint string) {
+	next := o.client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	client := *o.client
+	client.Transport = roundTripFunc(
+		func(r *http.Request) (*http.Response, error) {
+			if r.URL.Hostname() == "127.0.0.1" {
+				return next.RoundTrip(r)
+			}
+
+			rw := httptest.NewRecorder()
+			rw.Header().Set("Content-Type", contentTypeXRDS)
+			fmt.Fprintf(rw, `<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD><Service><Type>%s</Type><URI>%s</URI></Service></XRD>
+</xrds:XRDS>`, typeSignon, endpoint)
+
+			resp := rw.Result()
+			resp.Request = r
+			return resp, nil
+		})
+	o.client = &client
+}
+
+// nonceSeq keeps the response_nonce of idResRequest unique
+var nonceSeq uint64
+
+// idResRequest build a signed id_res callback request, all values are
+// signed. A fresh response_nonce is added unless values set one. A value
+// set empty leaves the field out, for addUnsigned to add it.
+func idResRequest(
+	t *testing.T, a *Association, values map[string]string) *http.Request {
+	t.Helper()
+
+	p := map[string]string{
+		"ns":           Namespace,
+		"mode":         "id_res",
+		"op_endpoint":  a.Endpoint,
+		"assoc_handle": a.Handle,
+		"claimed_id":   "https://openidprovider.com/id/alice",
+		"identity":     "https://openidprovider.com/id/alice",
+		"return_to":    ExpectedReturnTo(realm, callbackPrefix),
+		"response_nonce": time.Now().UTC().Format(time.RFC3339) +
+			strconv.FormatUint(atomic.AddUint64(&nonceSeq, 1), 10),
+	}
+	for k, v := range values {
+		p[k] = v
+	}
+	for k, v := range p {
+		if v == "" {
+			delete(p, k)
+		}
+	}
+
+	signed := make([]string, 0, len(p))
+	for k := range p {
+		if k != "ns" {
+			signed = append(signed, k)
+		}
+	}
+	sort.Strings(signed)
+	p["signed"] = strings.Join(signed, ",")
+
+	sig, err := a.sign(p, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p["sig"] = sig
+
+	v := url.Values{}
+	encodeHTTP(v, p)
+
+	return httptest.NewRequest(http.MethodGet,
+		ExpectedReturnTo(realm, callbackPrefix)+"?"+v.Encode(), nil)
+}
 
-// How to test openid without a openid provider ?
-// The fake login.example.com/openid is not exist.
 func Test_New_0(t *testing.T) {
 	o := New(realm)
 	if reflect.TypeOf(o).String() != "*openid.OpenID" {
 		t.Errorf("New return type error")
 	}
 }
+
+func Test_ExpectedReturnTo(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+
+	urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := u.Query().Get("openid.return_to")
+	if want := ExpectedReturnTo(realm, callbackPrefix); got != want {
+		t.Errorf("return_to %q, want %q", got, want)
+	}
+}
+
+func Test_ExpectedReturnTo_Slashes(t *testing.T) {
+	for _, tc := range []struct {
+		realm, callbackPrefix, want string
+	}{
+		{"https://x", "/openid/verify", "https://x/openid/verify"},
+		{"https://x/", "/openid/verify", "https://x/openid/verify"},
+		{"https://x", "openid/verify", "https://x/openid/verify"},
+		{"https://x/", "openid/verify", "https://x/openid/verify"},
+		{"https://x//", "//openid/verify", "https://x/openid/verify"},
+		{"https://x/app/", "/verify/", "https://x/app/verify/"},
+		{"https://x", "", "https://x"},
+		{"https://x", "myapp://auth", "myapp://auth"},
+	} {
+		if got := ExpectedReturnTo(tc.realm, tc.callbackPrefix); got != tc.want {
+			t.Errorf("ExpectedReturnTo(%q, %q) = %q, want %q",
+				tc.realm, tc.callbackPrefix, got, tc.want)
+		}
+	}
+}
+
+func Test_SetAllowedEndpoints(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+	o.SetAllowedEndpoints(ts.URL + "/")
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Errorf("allowed endpoint: %v", err)
+	}
+
+	if _, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL), nil)); err != nil {
+		t.Errorf("allowed endpoint: %v", err)
+	}
+
+	evil := "https://evil.example.com/openid"
+
+	_, err := o.CheckIDSetup(evil, callbackPrefix)
+	if !errors.Is(err, ErrEndpointNotAllowed) {
+		t.Errorf("CheckIDSetup error %v, want %v", err, ErrEndpointNotAllowed)
+	}
+
+	_, err = o.IDRes(idResRequest(t, fakeAssociation(evil), nil))
+	if !errors.Is(err, ErrEndpointNotAllowed) {
+		t.Errorf("IDRes error %v, want %v", err, ErrEndpointNotAllowed)
+	}
+}
+
+func Test_associate_NoMacKey(t *testing.T) {
+	ts := newDirectServer(t, "ns:"+Namespace+"\n"+
+		"assoc_handle:fake-handle\n"+
+		"assoc_type:HMAC-SHA256\n"+
+		"session_type:no-encryption\n"+
+		"expires_in:3600\n")
+	o := New(realm)
+	o.client = ts.Client()
+
+	_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if !errors.Is(err, ErrIncompleteAssociation) {
+		t.Errorf("association without mac_key: %v, want %v",
+			err, ErrIncompleteAssociation)
+	}
+
+	if _, ok := o.association(ts.URL, 0); ok {
+		t.Errorf("association without mac_key should not be stored")
+	}
+}
+
+func Test_associate_Truncated(t *testing.T) {
+	body := "ns:" + Namespace + "\n" +
+		"assoc_handle:fake-handle\n" +
+		"assoc_type:HMAC-SHA1\n" +
+		"session_type:no-encryption\n" +
+		"expires_in:3600\n" +
+		"mac_key:" + base64.StdEncoding.EncodeToString(fakeSecret[:20]) + "\n"
+
+	for _, n := range []int{
+		strings.Index(body, "mac_key:"),
+		strings.Index(body, "expires_in:") + len("expires"),
+	} {
+		ts := newDirectServer(t, body[:n])
+		o := New(realm)
+		o.client = ts.Client()
+
+		_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+		if !errors.Is(err, ErrIncompleteAssociation) {
+			t.Errorf("body truncated at %d: %v, want %v",
+				n, err, ErrIncompleteAssociation)
+		}
+
+		if _, ok := o.association(ts.URL, 0); ok {
+			t.Errorf("truncated association should not be stored")
+		}
+	}
+}
+
+func Test_CheckIDSetup_Reproducible(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+
+	first, err := o.CheckIDSetup(ts.URL, callbackPrefix, "email,nickname")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		next, err := o.CheckIDSetup(ts.URL, callbackPrefix, "email,nickname")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != first {
+			t.Fatalf("CheckIDSetup not reproducible:\n%s\n%s", first, next)
+		}
+	}
+}
+
+func Test_SetSRegAliases(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+	o.SetSRegAliases(ts.URL, map[string]string{"emailaddress": "email"})
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := o.IDRes(idResRequest(t, fakeAssociation(ts.URL),
+		map[string]string{
+			"ns.sreg":           NSSreg,
+			"sreg.emailaddress": "alice@example.com",
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := user["sreg.email"]; got != "alice@example.com" {
+		t.Errorf("sreg.email %q, want %q", got, "alice@example.com")
+	}
+	if _, ok := user["sreg.emailaddress"]; ok {
+		t.Errorf("aliased field sreg.emailaddress should be renamed")
+	}
+}
+
+func Test_SetDecodeTwice(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	// alice+tag@example.com url-encoded twice
+	fields := map[string]string{
+		"ns.sreg":         NSSreg,
+		"sreg.email":      "alice%2Btag%40example.com",
+		"ns.ext1":         NSAX,
+		"ext1.mode":       "fetch_response",
+		"ext1.type.mail":  axTypeEmail,
+		"ext1.value.mail": "alice%2Btag%40example.com",
+	}
+
+	user, err := o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user["sreg.email"]; got != fields["sreg.email"] {
+		t.Errorf("sreg.email %q without quirk, want %q", got, fields["sreg.email"])
+	}
+
+	o.SetDecodeTwice(assoc.Endpoint+"/", true)
+	user, err = o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "alice+tag@example.com"
+	if got := user["sreg.email"]; got != want {
+		t.Errorf("sreg.email %q, want %q", got, want)
+	}
+	if got := user["ext1.value.mail"]; got != want {
+		t.Errorf("ext1.value.mail %q, want %q", got, want)
+	}
+}
+
+func Test_SetNicknameFallback(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	fields := map[string]string{
+		"ns.sreg":       NSSreg,
+		"sreg.fullname": "Alice Liddell",
+	}
+
+	user, err := o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := user["sreg.nickname"]; ok {
+		t.Errorf("sreg.nickname should be absent without fallback")
+	}
+
+	o.SetNicknameFallback(true)
+	user, err = o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user["sreg.nickname"]; got != "Alice Liddell" {
+		t.Errorf("sreg.nickname %q, want the fullname", got)
+	}
+
+	fields["sreg.nickname"] = "alice"
+	user, err = o.IDRes(idResRequest(t, assoc, fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user["sreg.nickname"]; got != "alice" {
+		t.Errorf("sreg.nickname %q, want %q", got, "alice")
+	}
+}
+
+func Test_SetAssocGracePeriod(t *testing.T) {
+	endpoint := newCheckAuthProvider(t, false, "").URL
+	assoc := fakeAssociation(endpoint)
+	assoc.Expires = time.Now().Add(-time.Second)
+
+	o := New(realm)
+	o.assocs.Set(endpoint, *assoc)
+	serveDiscovery(o, endpoint)
+	logInWith(o, endpoint)
+
+	_, err := o.IDRes(idResRequest(t, assoc, nil))
+	if !errors.Is(err, ErrDirectVerifyFailed) {
+		t.Errorf("expired association without grace period: %v, want %v",
+			err, ErrDirectVerifyFailed)
+	}
+
+	o.SetAssocGracePeriod(time.Minute)
+	o.assocs.Set(endpoint, *assoc)
+
+	if _, err := o.IDRes(idResRequest(t, assoc, nil)); err != nil {
+		t.Errorf("association expired within grace period: %v", err)
+	}
+
+	if _, ok := o.association(endpoint, 0); ok {
+		t.Errorf("expired association should not be used for CheckIDSetup")
+	}
+}
+
+func Test_CheckIDSetup_Stateless(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	o.SetStateless(true)
+
+	urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := u.Query()["openid.assoc_handle"]; ok {
+		t.Errorf("openid.assoc_handle should be absent in stateless mode")
+	}
+}
+
+func Test_SetRandReader(t *testing.T) {
+	random := func() []byte {
+		o := New(realm)
+		o.SetRandReader(strings.NewReader(strings.Repeat("fixed random ", 8)))
+
+		b, err := o.randomBytes(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	if a, b := random(), random(); !bytes.Equal(a, b) {
+		t.Errorf("fixed reader gives different output %x and %x", a, b)
+	}
+
+	o := New(realm)
+	o.SetRandReader(strings.NewReader("short"))
+	if _, err := o.randomBytes(32); err == nil {
+		t.Errorf("exhausted reader should fail")
+	}
+}
+
+func Test_SetEndpointPinning(t *testing.T) {
+	first := fakeAssociation("https://openidprovider.com/openid")
+	second := fakeAssociation("https://other.example.com/openid")
+
+	o := New(realm)
+	o.assocs.Set(first.Endpoint, *first)
+	o.assocs.Set(second.Endpoint, *second)
+
+	// the claimed_id moves from the first endpoint to the second one,
+	// followed when disabled, the default
+	for _, a := range []*Association{first, second} {
+		serveDiscovery(o, a.Endpoint)
+		if _, err := o.IDRes(idResRequest(t, a, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o = New(realm)
+	o.assocs.Set(first.Endpoint, *first)
+	o.assocs.Set(second.Endpoint, *second)
+	o.SetEndpointPinning(true)
+
+	// not pinned to an endpoint discovery does not confirm
+	serveDiscovery(o, first.Endpoint)
+	_, err := o.IDRes(idResRequest(t, second, nil))
+	if !errors.Is(err, ErrDiscoveryMismatch) {
+		t.Errorf("IDRes error %v, want %v", err, ErrDiscoveryMismatch)
+	}
+	if _, err := o.IDRes(idResRequest(t, first, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	serveDiscovery(o, second.Endpoint)
+	_, err = o.IDRes(idResRequest(t, second, nil))
+	if !errors.Is(err, ErrEndpointChanged) {
+		t.Errorf("IDRes error %v, want %v", err, ErrEndpointChanged)
+	}
+
+	serveDiscovery(o, first.Endpoint)
+	if _, err := o.IDRes(idResRequest(t, first, nil)); err != nil {
+		t.Errorf("pinned endpoint: %v", err)
+	}
+}
+
+func Test_RedirectToLogin(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+
+	want, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/openid/login", nil)
+	if err := o.RedirectToLogin(rw, r, ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusFound {
+		t.Errorf("status %d, want %d", rw.Code, http.StatusFound)
+	}
+	if got := rw.Header().Get("Location"); got != want {
+		t.Errorf("Location %q, want %q", got, want)
+	}
+
+	broken := newDirectServer(t, "not a key-value response")
+	rw = httptest.NewRecorder()
+	if err := o.RedirectToLogin(rw, r, broken.URL, callbackPrefix); err == nil {
+		t.Errorf("failed association should return an error")
+	}
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+}
+
+func Test_IDRes_UnsignedNonce(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	nonce := time.Now().UTC().Format(time.RFC3339) + "abc"
+
+	r := idResRequest(t, assoc, map[string]string{"response_nonce": nonce})
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("signed response_nonce: %v", err)
+	}
+
+	r = addUnsigned(idResRequest(t, assoc,
+		map[string]string{"response_nonce": ""}),
+		map[string]string{"response_nonce": nonce + "unsigned"})
+	if _, err := o.IDRes(r); !errors.Is(err, ErrNonceNotSigned) {
+		t.Errorf("IDRes error %v, want %v", err, ErrNonceNotSigned)
+	}
+
+	r = idResRequest(t, assoc, map[string]string{"response_nonce": ""})
+	if _, err := o.IDRes(r); !errors.Is(err, ErrNonceMissing) {
+		t.Errorf("IDRes error %v, want %v", err, ErrNonceMissing)
+	}
+}
+
+func Test_associate_WeakKey(t *testing.T) {
+	zero := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	ts := newDirectServer(t, "ns:"+Namespace+"\n"+
+		"assoc_handle:fake-handle\n"+
+		"assoc_type:HMAC-SHA256\n"+
+		"session_type:no-encryption\n"+
+		"expires_in:3600\n"+
+		"mac_key:"+zero+"\n")
+	o := New(realm)
+	o.client = ts.Client()
+
+	_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if !errors.Is(err, ErrWeakAssociationKey) {
+		t.Errorf("all-zero mac_key error %v, want %v", err, ErrWeakAssociationKey)
+	}
+}
+
+func Test_Reassociate(t *testing.T) {
+	var n int
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n++
+			fmt.Fprintf(w, "assoc_handle:handle-%d\n", n)
+			fmt.Fprintf(w, "assoc_type:%s\n", hmacSHA256)
+			fmt.Fprintf(w, "expires_in:%d\n", 3600)
+			fmt.Fprintf(w, "mac_key:%s\n",
+				base64.StdEncoding.EncodeToString(fakeSecret))
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	o.client = ts.Client()
+	handle := func() string {
+		urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query().Get("openid.assoc_handle")
+	}
+
+	first := handle()
+	if cached := handle(); cached != first {
+		t.Fatalf("cached handle %q, want %q", cached, first)
+	}
+
+	if err := o.Reassociate(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if fresh := handle(); fresh == first {
+		t.Errorf("handle %q not renewed by Reassociate", fresh)
+	}
+}
+
+func Test_SetMaxURLLength(t *testing.T) {
+	handle := strings.Repeat("h", 4096)
+	ts := newDirectServer(t, "assoc_handle:"+handle+"\n"+
+		"assoc_type:HMAC-SHA256\n"+
+		"expires_in:3600\n"+
+		"mac_key:"+base64.StdEncoding.EncodeToString(fakeSecret)+"\n")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	o := New(realm)
+	o.client = ts.Client()
+	o.SetMaxURLLength(2048, true)
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/openid/login", nil)
+	if err := o.RedirectToLogin(rw, r, ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logs.String(), "exceeds 2048 bytes") {
+		t.Errorf("overlong url not logged: %q", logs.String())
+	}
+	if rw.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", rw.Code, http.StatusOK)
+	}
+
+	body := rw.Body.String()
+	for _, want := range []string{
+		`<form method="post" action="` + ts.URL + `">`,
+		`name="openid.assoc_handle" value="` + handle + `"`,
+		`name="openid.mode" value="checkid_setup"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("form missing %q", want)
+		}
+	}
+}
+
+func Test_SetIdentityTransform(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	o.SetIdentityTransform(func(claimedID string) string {
+		id := strings.ToLower(claimedID)
+		id = strings.TrimPrefix(strings.TrimPrefix(id, "https://"), "http://")
+		id = strings.TrimRight(id, "/")
+		sum := sha256.Sum256([]byte(id))
+		return hex.EncodeToString(sum[:])
+	})
+
+	subject := func(claimedID string) string {
+		user, err := o.IDRes(idResRequest(t, assoc, map[string]string{
+			"claimed_id": claimedID,
+			"identity":   claimedID,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user["subject"]
+	}
+
+	want := subject("https://openidprovider.com/id/alice")
+	if want == "" {
+		t.Fatalf("subject not set")
+	}
+	if got := subject("HTTP://OpenIDProvider.com/id/Alice/"); got != want {
+		t.Errorf("subject %q, want %q", got, want)
+	}
+}
+
+func Test_SetAssocType(t *testing.T) {
+	o := New(realm)
+
+	for _, assocType := range []string{"HMAC-SHA1", "HMAC-SHA256"} {
+		if err := o.SetAssocType(assocType); err != nil {
+			t.Errorf("SetAssocType(%q): %v", assocType, err)
+		}
+		if got := o.assocPrefs[0].AssocType; got != assocType {
+			t.Errorf("assoc type %q, want %q", got, assocType)
+		}
+	}
+
+	for _, assocType := range []string{"", "HMAC-SHA-256", "hmac-sha256"} {
+		if err := o.SetAssocType(assocType); err == nil {
+			t.Errorf("SetAssocType(%q) should fail", assocType)
+		}
+	}
+	if got := o.assocPrefs[0].AssocType; got != hmacSHA256 {
+		t.Errorf("invalid type changed assoc type to %q", got)
+	}
+}
+
+func Test_IsCallback(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		want   bool
+	}{
+		{"/openid/verify?openid.mode=id_res&openid.sig=xyz", true},
+		{"/openid/verify?openid.mode=setup_needed", true},
+		{"/openid/verify?openid.mode=cancel", true},
+		{"/openid/verify?openid.mode=error&openid.error=oops", true},
+		{"/openid/verify?OpenID.Mode=cancel", false},
+		{"/openid/verify?openid.mode=checkid_setup", false},
+		{"/openid/verify?mode=id_res", false},
+		{"/openid/verify", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if got := IsCallback(r); got != tc.want {
+			t.Errorf("IsCallback(%s) %v, want %v", tc.target, got, tc.want)
+		}
+	}
+}
+
+func Test_IDRes_POST(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	get := idResRequest(t, assoc, map[string]string{
+		"ns.sreg":    NSSreg,
+		"sreg.email": "alice@example.com",
+	})
+	post := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost,
+			ExpectedReturnTo(realm, callbackPrefix), strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	r := post(get.URL.RawQuery)
+	if !IsCallback(r) {
+		t.Errorf("POST callback not recognized")
+	}
+	user, err := o.IDRes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := user["sreg.email"]; got != "alice@example.com" {
+		t.Errorf("sreg.email %q, want %q", got, "alice@example.com")
+	}
+
+	huge := "openid.mode=id_res&x=" + strings.Repeat("a", maxCallbackBody)
+	if _, err := o.IDRes(post(huge)); err == nil {
+		t.Errorf("callback body over %d bytes should fail", maxCallbackBody)
+	}
+}
+
+func Test_CheckIDImmediate(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+
+	urlStr, err := o.CheckIDImmediate(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := u.Query().Get("openid.mode"); mode != "checkid_immediate" {
+		t.Errorf("openid.mode %q, want checkid_immediate", mode)
+	}
+
+	for _, query := range []string{
+		"?openid.ns=" + url.QueryEscape(Namespace) + "&openid.mode=setup_needed",
+		// OpenID 1.1
+		"?openid.mode=id_res&openid.user_setup_url=" +
+			url.QueryEscape(ts.URL+"/setup"),
+	} {
+		r := httptest.NewRequest(http.MethodGet, callbackPrefix+query, nil)
+
+		a, err := o.IDResAssertion(r)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if !a.SetupNeeded {
+			t.Errorf("%s: SetupNeeded false, want true", query)
+		}
+
+		if _, err := o.IDRes(r); !errors.Is(err, ErrSetupNeeded) {
+			t.Errorf("%s: IDRes %v, want %v", query, err, ErrSetupNeeded)
+		}
+	}
+}
+
+func Test_SetAssocPreferences(t *testing.T) {
+	var requested []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assocType := r.URL.Query().Get("openid.assoc_type")
+			requested = append(requested, assocType)
+
+			if assocType != hmacSHA1 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error:unsupported association type\n")
+				fmt.Fprintf(w, "error_code:unsupported-type\n")
+				return
+			}
+			fmt.Fprintf(w, "assoc_handle:sha1-handle\n")
+			fmt.Fprintf(w, "assoc_type:%s\n", hmacSHA1)
+			fmt.Fprintf(w, "session_type:%s\n", noEncryption)
+			fmt.Fprintf(w, "expires_in:%d\n", 3600)
+			fmt.Fprintf(w, "mac_key:%s\n",
+				base64.StdEncoding.EncodeToString(fakeSecret[:20]))
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	o.client = ts.Client()
+	err := o.SetAssocPreferences(
+		AssocPreference{AssocType: hmacSHA256, SessionType: noEncryption},
+		AssocPreference{AssocType: hmacSHA1, SessionType: noEncryption},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{hmacSHA256, hmacSHA1}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("requested %v, want %v", requested, want)
+	}
+
+	assoc, ok := o.association(ts.URL, 0)
+	if !ok {
+		t.Fatalf("no association stored")
+	}
+	if assoc.Type != hmacSHA1 {
+		t.Errorf("association type %q, want %q", assoc.Type, hmacSHA1)
+	}
+
+	if err := o.SetAssocPreferences(); err == nil {
+		t.Errorf("empty preferences should fail")
+	}
+	err = o.SetAssocPreferences(
+		AssocPreference{AssocType: hmacSHA256, SessionType: "DH-MD5"})
+	if err == nil {
+		t.Errorf("unsupported session type should fail")
+	}
+}
+
+func Test_associate_SuggestedType(t *testing.T) {
+	var requested []string
+	accept := hmacSHA1
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assocType := r.URL.Query().Get("openid.assoc_type")
+			requested = append(requested, assocType)
+
+			if assocType != accept {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "error:unsupported association type\n")
+				fmt.Fprintf(w, "error_code:unsupported-type\n")
+				fmt.Fprintf(w, "assoc_type:%s\n", hmacSHA1)
+				fmt.Fprintf(w, "session_type:%s\n", noEncryption)
+				return
+			}
+			fmt.Fprintf(w, "assoc_handle:sha1-handle\n")
+			fmt.Fprintf(w, "assoc_type:%s\n", hmacSHA1)
+			fmt.Fprintf(w, "session_type:%s\n", noEncryption)
+			fmt.Fprintf(w, "expires_in:%d\n", 3600)
+			fmt.Fprintf(w, "mac_key:%s\n",
+				base64.StdEncoding.EncodeToString(fakeSecret[:20]))
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	o.client = ts.Client()
+	err := o.SetAssocPreferences(
+		AssocPreference{AssocType: hmacSHA256, SessionType: noEncryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assoc, err := o.associate(context.Background(), ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assoc.Type != hmacSHA1 {
+		t.Errorf("association type %q, want %q", assoc.Type, hmacSHA1)
+	}
+
+	want := []string{hmacSHA256, hmacSHA1}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("requested %v, want %v", requested, want)
+	}
+
+	// the suggestion is only followed once
+	requested, accept = nil, "none"
+	if _, err := o.associate(context.Background(), ts.URL, true); err == nil {
+		t.Errorf("rejected suggestion should fail")
+	}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("requested %v, want %v", requested, want)
+	}
+}
+
+func Test_associate_Rejected(t *testing.T) {
+	requests := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "error:missing openid.ns\n")
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	o.client = ts.Client()
+
+	_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if !errors.Is(err, ErrAssociateRejected) {
+		t.Fatalf("400 response: %v, want %v", err, ErrAssociateRejected)
+	}
+	if !errors.Is(err, ErrAssociateFailed) {
+		t.Errorf("400 response: %v, want %v", err, ErrAssociateFailed)
+	}
+	if !strings.Contains(err.Error(), "missing openid.ns") {
+		t.Errorf("error %q should include the response body", err)
+	}
+	if requests != 1 {
+		t.Errorf("%d association requests, want 1", requests)
+	}
+
+	if _, ok := o.association(ts.URL, 0); ok {
+		t.Errorf("rejected association should not be stored")
+	}
+}
+
+func Test_associate_ResponseHeaders(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprintf(w, "error:slow down\n")
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	o.client = ts.Client()
+
+	_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		t.Fatalf("association failure %v, want a *ResponseError", err)
+	}
+	if respErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("status %d, want %d",
+			respErr.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := respErr.Header.Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("X-RateLimit-Remaining %q, want %q", got, "0")
+	}
+	if !errors.Is(err, ErrAssociateRejected) {
+		t.Errorf("association failure %v, want %v", err, ErrAssociateRejected)
+	}
+}
+
+func Test_CheckIDSetup_RequestSigning(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	o.SetRequestSigning(true)
+
+	urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := parseHTTP(u.Query())
+
+	want := "mode,assoc_handle,return_to,realm,claimed_id,identity"
+	if values["signed"] != want {
+		t.Errorf("signed %q, want %q", values["signed"], want)
+	}
+
+	assoc, ok := o.association(ts.URL, 0)
+	if !ok {
+		t.Fatalf("no association stored")
+	}
+	if valid, err := VerifySignature(*assoc, values); err != nil || !valid {
+		t.Errorf("request signature not valid: %v", err)
+	}
+
+	o.SetStateless(true)
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); !errors.Is(err, ErrNoAssociation) {
+		t.Errorf("request signing in stateless mode: %v, want %v",
+			err, ErrNoAssociation)
+	}
+}
+
+func Test_CheckIDSetupContext_Cancel(t *testing.T) {
+	// a hung OpenID Server
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := o.CheckIDSetupContext(ctx, ts.URL, callbackPrefix)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled association error %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("canceled association returned after %v", d)
+	}
+}
+
+func Test_CheckIDSetupContext_Deadline(t *testing.T) {
+	// a slow OpenID Server
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+	defer ts.Close()
+
+	o := New(realm)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := o.CheckIDSetupContext(ctx, ts.URL, callbackPrefix)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("deadline error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	var phaseErr *PhaseError
+	if !errors.As(err, &phaseErr) {
+		t.Fatalf("deadline error %T, want *PhaseError", err)
+	}
+	if phaseErr.Phase != PhaseAssociate || phaseErr.Endpoint != ts.URL {
+		t.Errorf("deadline error in %s %s, want %s %s",
+			phaseErr.Phase, phaseErr.Endpoint, PhaseAssociate, ts.URL)
+	}
+
+	// expired with the association cached
+	o.assocs.Set(ts.URL, *fakeAssociation(ts.URL))
+	_, err = o.CheckIDSetupContext(ctx, ts.URL, callbackPrefix)
+	if !errors.As(err, &phaseErr) || phaseErr.Phase != PhaseCheckIDSetup {
+		t.Errorf("deadline error %v, want a %s *PhaseError",
+			err, PhaseCheckIDSetup)
+	}
+}
+
+func Test_SetSRegFields(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+
+	query := func(optional ...string) url.Values {
+		t.Helper()
+		urlStr, err := o.CheckIDSetup(ts.URL, callbackPrefix, optional...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query()
+	}
+
+	if got := query().Get("openid.sreg.required"); got != "nickname,email,fullname" {
+		t.Errorf("default sreg.required %q", got)
+	}
+
+	err := o.SetSRegFields([]string{"email"}, []string{"country", "language"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := query()
+	if got := q.Get("openid.sreg.required"); got != "email" {
+		t.Errorf("sreg.required %q, want %q", got, "email")
+	}
+	if got := q.Get("openid.sreg.optional"); got != "country,language" {
+		t.Errorf("sreg.optional %q, want %q", got, "country,language")
+	}
+
+	// the fields given to CheckIDSetup still win
+	if got := query("nickname").Get("openid.sreg.required"); got != "nickname" {
+		t.Errorf("sreg.required %q, want %q", got, "nickname")
+	}
+
+	if err := o.SetSRegFields(nil, []string{"dob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := query()["openid.sreg.required"]; ok {
+		t.Errorf("empty sreg.required should be omitted")
+	}
+
+	if err := o.SetSRegFields([]string{"email", "shoesize"}, nil); err == nil {
+		t.Errorf("unknown sreg field should fail")
+	}
+}
@@ -0,0 +1,39 @@
+package openidtest_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shuaiming/openid"
+	"github.com/shuaiming/openid/openidtest"
+)
+
+func ExampleNewRequest() {
+	assoc := openid.Association{
+		Endpoint: "https://openidprovider.com/openid",
+		Handle:   "handle",
+		Secret:   []byte("0123456789abcdef0123456789abcdef"),
+		Type:     "HMAC-SHA256",
+		Expires:  time.Now().Add(time.Hour),
+	}
+
+	o := openid.New("https://localhost")
+	o.SetAssociationStore(openidtest.NewStore(assoc))
+	o.SetHTTPClient(openidtest.DiscoveryClient(assoc.Endpoint))
+
+	r := openidtest.NewRequest(assoc, map[string]string{
+		"claimed_id":    "https://openidprovider.com/id/alice",
+		"identity":      "https://openidprovider.com/id/alice",
+		"return_to":     "https://localhost/openid/verify",
+		"ns.sreg":       openid.NSSreg,
+		"sreg.nickname": "alice",
+	})
+
+	user, err := o.IDRes(r)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(user["claimed_id"], user["sreg.nickname"])
+	// Output: https://openidprovider.com/id/alice alice
+}
@@ -0,0 +1,174 @@
+/*
+Package openidtest provides utilities for testing code built on package
+openid, like building the signed id_res callback an OpenID Server would
+redirect the User Agent to.
+*/
+package openidtest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shuaiming/openid"
+)
+
+// nonceSeq keeps the response_nonce of Query unique
+var nonceSeq uint64
+
+// Query build the signed id_res query string for fields, the openid values
+// without the "openid." prefix, like "claimed_id" or "return_to". mode,
+// op_endpoint and assoc_handle default to id_res and those of assoc, and
+// response_nonce to a fresh one. All fields but ns are signed with assoc.
+func Query(assoc openid.Association, fields map[string]string) (string, error) {
+	p := map[string]string{
+		"ns":           openid.Namespace,
+		"mode":         "id_res",
+		"op_endpoint":  assoc.Endpoint,
+		"assoc_handle": assoc.Handle,
+		"response_nonce": time.Now().UTC().Format(time.RFC3339) +
+			strconv.FormatUint(atomic.AddUint64(&nonceSeq, 1), 10),
+	}
+	for k, v := range fields {
+		p[k] = v
+	}
+
+	signed := make([]string, 0, len(p))
+	for k := range p {
+		if k != "ns" {
+			signed = append(signed, k)
+		}
+	}
+	sort.Strings(signed)
+	p["signed"] = strings.Join(signed, ",")
+
+	sig, err := sign(assoc, p, signed)
+	if err != nil {
+		return "", err
+	}
+	p["sig"] = sig
+
+	v := url.Values{}
+	for k, pv := range p {
+		v.Set("openid."+k, pv)
+	}
+	return v.Encode(), nil
+}
+
+// NewRequest build the signed id_res callback request to the return_to of
+// fields, see Query. It panics on failure, like httptest.NewRequest.
+func NewRequest(assoc openid.Association, fields map[string]string) *http.Request {
+	query, err := Query(assoc, fields)
+	if err != nil {
+		panic("openidtest: " + err.Error())
+	}
+	return httptest.NewRequest(http.MethodGet, fields["return_to"]+"?"+query, nil)
+}
+
+// DiscoveryClient return an http.Client answering every request with a
+// XRDS document of the OpenID Server endpoint, for openid.OpenID to
+// discover any claimed_id asserted by it without the network.
+func DiscoveryClient(endpoint string) *http.Client {
+	return &http.Client{Transport: roundTripFunc(
+		func(r *http.Request) (*http.Response, error) {
+			rw := httptest.NewRecorder()
+			rw.Header().Set("Content-Type", "application/xrds+xml")
+			fmt.Fprintf(rw, `<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD>
+    <Service>
+      <Type>http://specs.openid.net/auth/2.0/signon</Type>
+      <URI>%s</URI>
+    </Service>
+  </XRD>
+</xrds:XRDS>`, html.EscapeString(endpoint))
+
+			resp := rw.Result()
+			resp.Request = r
+			return resp, nil
+		})}
+}
+
+// roundTripFunc adapts a function to an http.RoundTripper
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+// RoundTrip call f(r)
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// sign values of signed keys with assoc, in the key-value form
+func sign(assoc openid.Association,
+	values map[string]string, signed []string) (string, error) {
+
+	var h hash.Hash
+
+	switch assoc.Type {
+	case "HMAC-SHA1":
+		h = hmac.New(sha1.New, assoc.Secret)
+	case "HMAC-SHA256":
+		h = hmac.New(sha256.New, assoc.Secret)
+	default:
+		return "", fmt.Errorf("unsupported association type %q", assoc.Type)
+	}
+
+	for _, k := range signed {
+		fmt.Fprintf(h, "%s:%s\n", k, values[k])
+	}
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// Store is an openid.AssociationStore in memory, to share associations
+// with the openid.OpenID under test.
+type Store struct {
+	mu     sync.Mutex
+	assocs map[string]openid.Association
+}
+
+// NewStore return a Store holding assocs with key of their endpoints
+func NewStore(assocs ...openid.Association) *Store {
+	s := &Store{assocs: make(map[string]openid.Association)}
+	for _, a := range assocs {
+		s.Set(a.Endpoint, a)
+	}
+	return s
+}
+
+// Get Association with key of endpoint
+func (s *Store) Get(endpoint string) (openid.Association, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.assocs[strings.TrimRight(endpoint, "/")]
+	return a, ok
+}
+
+// Set Association with key of endpoint
+func (s *Store) Set(endpoint string, a openid.Association) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assocs[strings.TrimRight(endpoint, "/")] = a
+}
+
+// Delete Association with key of endpoint
+func (s *Store) Delete(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.assocs, strings.TrimRight(endpoint, "/"))
+}
@@ -0,0 +1,222 @@
+package openid
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SetReturnToSchemes allow absolute return_to urls with custom schemes,
+// like "myapp" for the deep link myapp://auth of a mobile app. Such return_to
+// are exempt from the realm check, http and https are always checked.
+func (o *OpenID) SetReturnToSchemes(schemes ...string) {
+	o.returnToSchemes = make(map[string]bool, len(schemes))
+	for _, scheme := range schemes {
+		scheme = strings.ToLower(scheme)
+		if scheme != "http" && scheme != "https" {
+			o.returnToSchemes[scheme] = true
+		}
+	}
+}
+
+// checkReturnTo check returnTo is under the realm or has a custom scheme
+func (o *OpenID) checkReturnTo(returnTo string) error {
+	u, err := url.Parse(returnTo)
+	if err == nil && u.IsAbs() && o.returnToSchemes[strings.ToLower(u.Scheme)] {
+		return nil
+	}
+
+	// a relative callbackPrefix under a wildcard realm builds a return_to
+	// with the wildcard as its host
+	if err == nil && strings.Contains(u.Host, "*") {
+		return fmt.Errorf("%w: return_to %s has a wildcard host, "+
+			"the callbackPrefix has to be absolute under realm %s",
+			ErrRealmMismatch, returnTo, o.realm)
+	}
+
+	if !realmMatches(o.realm, returnTo) {
+		return fmt.Errorf("%w: return_to %s, realm %s",
+			ErrRealmMismatch, returnTo, o.realm)
+	}
+	return nil
+}
+
+// CheckReturnTo check the return_to built from realm and callbackPrefix is
+// an absolute url under realm, to call at startup to fail fast on a
+// misconfiguration.
+func CheckReturnTo(realm, callbackPrefix string) error {
+	r, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid realm %q: %w", realm, err)
+	}
+	if (r.Scheme != "http" && r.Scheme != "https") || r.Host == "" {
+		return fmt.Errorf("realm %q is not an absolute http or https url", realm)
+	}
+	if r.Fragment != "" || r.RawQuery != "" {
+		return fmt.Errorf("realm %q has a query or fragment", realm)
+	}
+
+	if _, err := url.Parse(callbackPrefix); err != nil {
+		return fmt.Errorf("invalid callbackPrefix %q: %w", callbackPrefix, err)
+	}
+
+	returnTo := ExpectedReturnTo(realm, callbackPrefix)
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return fmt.Errorf("invalid return_to %q: %w", returnTo, err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("return_to %q is not absolute", returnTo)
+	}
+	if strings.Contains(u.Host, "*") {
+		return fmt.Errorf("return_to %q has a wildcard host, "+
+			"use an absolute callbackPrefix with a wildcard realm", returnTo)
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("return_to %q has a fragment", returnTo)
+	}
+	if strings.Contains(u.EscapedPath(), "//") {
+		return fmt.Errorf("return_to %q has an empty path segment", returnTo)
+	}
+
+	if !realmMatches(realm, returnTo) {
+		return fmt.Errorf("%w: return_to %s, realm %s",
+			ErrRealmMismatch, returnTo, realm)
+	}
+	return nil
+}
+
+// SetCallbackOrigin set the scheme and host, like "https://example.com", the
+// OpenID Server redirects back to, and enable the check that the return_to
+// of an assertion has them. A response minted for another site under a
+// wildcard realm is rejected then. The check is off by default: behind a
+// reverse proxy terminating TLS or rewriting the Host header, the callback
+// request does not tell the origin the User Agent saw. An empty origin
+// turns the check off again.
+func (o *OpenID) SetCallbackOrigin(origin string) error {
+	if origin == "" {
+		o.callbackOrigin = nil
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid callback origin %q", origin)
+	}
+
+	o.callbackOrigin = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	return nil
+}
+
+// checkReturnToURL check returnTo matches the callback request r the OpenID
+// Server redirected to, which might have more parameters added by the
+// OpenID Server, like the openid.* ones
+func (o *OpenID) checkReturnToURL(returnTo string, r *http.Request) error {
+	rt, err := url.Parse(returnTo)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReturnToMismatch, err)
+	}
+	if rt.IsAbs() && o.returnToSchemes[strings.ToLower(rt.Scheme)] {
+		return nil
+	}
+
+	if origin := o.callbackOrigin; origin != nil {
+		scheme, host := origin.Scheme, origin.Host
+		if !strings.EqualFold(rt.Scheme, scheme) ||
+			!strings.EqualFold(hostPort(rt.Scheme, rt.Host), hostPort(scheme, host)) {
+			return fmt.Errorf("%w: origin %s://%s, want %s://%s",
+				ErrReturnToMismatch, scheme, host, rt.Scheme, rt.Host)
+		}
+	}
+
+	u := r.URL
+
+	if rt.EscapedPath() != u.EscapedPath() {
+		return fmt.Errorf("%w: path %s, want %s",
+			ErrReturnToMismatch, u.EscapedPath(), rt.EscapedPath())
+	}
+
+	query := u.Query()
+	for k, want := range rt.Query() {
+		got := query[k]
+		if len(got) != len(want) {
+			return fmt.Errorf("%w: parameter %s", ErrReturnToMismatch, k)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				return fmt.Errorf("%w: parameter %s", ErrReturnToMismatch, k)
+			}
+		}
+	}
+	return nil
+}
+
+// hostPort strip the default port of scheme from host
+func hostPort(scheme, host string) string {
+	switch strings.ToLower(scheme) {
+	case "http":
+		return strings.TrimSuffix(host, ":80")
+	case "https":
+		return strings.TrimSuffix(host, ":443")
+	}
+	return host
+}
+
+// realmMatches report whether returnTo is under realm, following the OpenID
+// realm rules: same scheme and port, a host equal to the realm host or, for
+// a realm host like "*.example.com", any subdomain of example.com, and a
+// path under the realm path.
+func realmMatches(realm, returnTo string) bool {
+	r, err := url.Parse(realm)
+	if err != nil || r.Fragment != "" {
+		return false
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return false
+	}
+
+	if !strings.EqualFold(r.Scheme, u.Scheme) || r.Port() != u.Port() {
+		return false
+	}
+
+	if !hostMatches(r.Hostname(), u.Hostname()) {
+		return false
+	}
+
+	return pathMatches(r.EscapedPath(), u.EscapedPath())
+}
+
+// hostMatches match host against the realm host, which might have a single
+// leading "*." wildcard. host itself never has one.
+func hostMatches(realmHost, host string) bool {
+	realmHost, host = strings.ToLower(realmHost), strings.ToLower(host)
+	if strings.Contains(host, "*") {
+		return false
+	}
+
+	if !strings.HasPrefix(realmHost, "*.") {
+		return realmHost == host
+	}
+
+	domain := strings.TrimPrefix(realmHost, "*.")
+	if domain == "" || strings.Contains(domain, "*") {
+		return false
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// pathMatches report whether path is under the realm path
+func pathMatches(realmPath, path string) bool {
+	if realmPath == "" || realmPath == "/" || realmPath == path {
+		return true
+	}
+	if strings.HasSuffix(realmPath, "/") {
+		return strings.HasPrefix(path, realmPath)
+	}
+	return strings.HasPrefix(path, realmPath+"/")
+}
@@ -0,0 +1,224 @@
+package openid
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func Test_realmMatches(t *testing.T) {
+	for _, tc := range []struct {
+		realm, returnTo string
+		want            bool
+	}{
+		{"https://localhost", "https://localhost/openid/verify", true},
+		{"https://localhost/", "https://localhost/openid/verify", true},
+		{"https://localhost", "http://localhost/openid/verify", false},
+		{"https://localhost", "https://localhost:8443/openid/verify", false},
+		{"https://example.com/openid", "https://example.com/openid/verify", true},
+		{"https://example.com/openid", "https://example.com/openidx", false},
+		{"https://*.example.com", "https://www.example.com/verify", true},
+		{"https://*.example.com", "https://a.b.example.com/verify", true},
+		{"https://*.example.com", "https://example.com/verify", true},
+		{"https://*.example.com", "https://www.example.org/verify", false},
+		{"https://*.example.com", "https://evilexample.com/verify", false},
+		{"https://*.example.com", "https://example.com.evil.org/", false},
+		{"https://www.*.example.com", "https://www.a.example.com/", false},
+		{"https://*.example.com", "https://*.example.com/verify", false},
+	} {
+		if got := realmMatches(tc.realm, tc.returnTo); got != tc.want {
+			t.Errorf("realmMatches(%q, %q) %v, want %v",
+				tc.realm, tc.returnTo, got, tc.want)
+		}
+	}
+}
+
+func Test_CheckReturnTo(t *testing.T) {
+	for _, tc := range []struct {
+		realm, callbackPrefix string
+		ok                    bool
+	}{
+		{"https://example.com", "/openid/verify", true},
+		{"https://*.example.com", "https://www.example.com/verify", true},
+		{"https://*.example.com", "/openid/verify", false},
+		{"https://example.com/app/", "https://example.com/app/verify", true},
+		{"https://example.com/", "/openid/verify", true},
+		{"https://example.com", "openid/verify", true},
+		{"https://example.com", "/openid//verify", false},
+		{"https://example.com", "http://example.com/openid/verify", false},
+		{"http://example.com", "https://example.com/openid/verify", false},
+		{"https://example.com/app", "https://example.com/other/verify", false},
+		{"https://example.com", "https://evil.example.net/verify", false},
+		{"example.com", "/openid/verify", false},
+		{"https://example.com#top", "/openid/verify", false},
+		{"https://example.com", "/openid/verify#top", false},
+	} {
+		err := CheckReturnTo(tc.realm, tc.callbackPrefix)
+		if (err == nil) != tc.ok {
+			t.Errorf("CheckReturnTo(%q, %q) = %v, want ok %v",
+				tc.realm, tc.callbackPrefix, err, tc.ok)
+		}
+	}
+}
+
+func Test_IDRes_WildcardRealm(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New("https://*.example.com")
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	r := idResRequest(t, assoc, map[string]string{
+		"return_to": "https://www.example.com/openid/verify",
+	})
+	r.Host = "www.example.com"
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("return_to under wildcard realm: %v", err)
+	}
+
+	r = idResRequest(t, assoc, map[string]string{
+		"return_to": "https://www.example.org/openid/verify",
+	})
+	if _, err := o.IDRes(r); !errors.Is(err, ErrRealmMismatch) {
+		t.Errorf("IDRes error %v, want %v", err, ErrRealmMismatch)
+	}
+}
+
+func Test_CheckIDSetup_WildcardRealm(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New("https://*.example.com")
+	serveDiscovery(o, ts.URL)
+
+	_, err := o.CheckIDSetup(ts.URL, callbackPrefix)
+	if !errors.Is(err, ErrRealmMismatch) {
+		t.Errorf("relative callbackPrefix error %v, want %v", err, ErrRealmMismatch)
+	}
+
+	returnTo := "https://www.example.com/openid/verify"
+	urlStr, err := o.CheckIDSetup(ts.URL, returnTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("openid.return_to"); got != returnTo {
+		t.Errorf("return_to %q, want %q", got, returnTo)
+	}
+}
+
+func Test_CheckIDSetup_CustomScheme(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	deepLink := "myapp://auth"
+
+	_, err := o.CheckIDSetup(ts.URL, deepLink)
+	if !errors.Is(err, ErrRealmMismatch) {
+		t.Errorf("unregistered scheme error %v, want %v", err, ErrRealmMismatch)
+	}
+
+	o.SetReturnToSchemes("myapp")
+
+	urlStr, err := o.CheckIDSetup(ts.URL, deepLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("openid.return_to"); got != deepLink {
+		t.Errorf("return_to %q, want %q", got, deepLink)
+	}
+
+	assoc := fakeAssociation(ts.URL)
+	r := idResRequest(t, assoc, map[string]string{"return_to": deepLink})
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("verify custom scheme return_to: %v", err)
+	}
+
+	_, err = o.CheckIDSetup(ts.URL, "https://evil.example.com/verify")
+	if !errors.Is(err, ErrRealmMismatch) {
+		t.Errorf("off-realm return_to error %v, want %v", err, ErrRealmMismatch)
+	}
+}
+
+func Test_IDRes_ReturnToProviderParams(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	returnTo := ExpectedReturnTo(realm, callbackPrefix) + "?state=abc"
+
+	for _, tc := range []struct {
+		state string
+		want  error
+	}{
+		{"abc", nil},
+		{"xyz", ErrReturnToMismatch},
+	} {
+		r := idResRequest(t, assoc, map[string]string{"return_to": returnTo})
+
+		// the OpenID Server added its own parameters beyond ours
+		q := r.URL.Query()
+		q.Set("state", tc.state)
+		q.Set("openid.provider_extra", "1")
+		r.URL.RawQuery = q.Encode()
+
+		if _, err := o.IDRes(r); !errors.Is(err, tc.want) {
+			t.Errorf("state %s: IDRes error %v, want %v", tc.state, err, tc.want)
+		}
+	}
+
+	r := idResRequest(t, assoc, map[string]string{"return_to": returnTo})
+	r.URL.Path = "/elsewhere"
+	if _, err := o.IDRes(r); !errors.Is(err, ErrReturnToMismatch) {
+		t.Errorf("other path: IDRes error %v, want %v", err, ErrReturnToMismatch)
+	}
+}
+
+func Test_IDRes_ReturnToOrigin(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New("https://*.localhost")
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	// behind a reverse proxy terminating TLS, the callback request tells
+	// nothing of the origin, nor is it checked by default
+	r := idResRequest(t, assoc, nil)
+	r.Host, r.TLS = "backend:8080", nil
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("default origin: %v", err)
+	}
+
+	if err := o.SetCallbackOrigin("https://localhost"); err != nil {
+		t.Fatal(err)
+	}
+	r = idResRequest(t, assoc, nil)
+	r.Host, r.TLS = "backend:8080", nil
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("configured origin: %v", err)
+	}
+
+	// a response minted for another site under the same realm
+	other := "https://other.localhost" + callbackPrefix
+	r = idResRequest(t, assoc, map[string]string{"return_to": other})
+	if _, err := o.IDRes(r); !errors.Is(err, ErrReturnToMismatch) {
+		t.Errorf("other host: IDRes error %v, want %v", err, ErrReturnToMismatch)
+	}
+
+	if err := o.SetCallbackOrigin("https://localhost:443"); err != nil {
+		t.Fatal(err)
+	}
+	r = idResRequest(t, assoc, nil)
+	if _, err := o.IDRes(r); err != nil {
+		t.Errorf("default port: %v", err)
+	}
+
+	if err := o.SetCallbackOrigin("localhost"); err == nil {
+		t.Errorf("origin without scheme should fail")
+	}
+}
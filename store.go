@@ -0,0 +1,70 @@
+package openid
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// AssociationStore stores associations with key of OpenID endpoint, like a
+// shared store for all instances of a Consumer behind a load balancer.
+// Implementations must be safe for concurrent use.
+type AssociationStore interface {
+	// Get Association with key of endpoint
+	Get(endpoint string) (Association, bool)
+	// Set Association with key of endpoint
+	Set(endpoint string, a Association)
+	// Delete Association with key of endpoint
+	Delete(endpoint string)
+}
+
+// associations store association with key of OpenID endpoint in memory
+type associations struct {
+	sync.Map
+}
+
+// Get Association with key of endpoint
+func (as *associations) Get(endpoint string) (Association, bool) {
+	value, ok := as.Load(strings.TrimRight(endpoint, "/"))
+	if !ok {
+		return Association{}, false
+	}
+	return value.(Association), true
+}
+
+// Set Association with key of endpoint
+func (as *associations) Set(endpoint string, a Association) {
+	as.Store(strings.TrimRight(endpoint, "/"), a)
+}
+
+// Delete Association with key of endpoint
+func (as *associations) Delete(endpoint string) {
+	as.Map.Delete(strings.TrimRight(endpoint, "/"))
+}
+
+// readOnlyStore serves Get of store but ignores Set and Delete
+type readOnlyStore struct {
+	store AssociationStore
+}
+
+// ReadOnlyStore wraps store to serve Get only, Set and Delete are logged and
+// ignored. Use it to verify assertions against a frozen snapshot of
+// associations, like during a blue/green cutover, without evicting them.
+func ReadOnlyStore(store AssociationStore) AssociationStore {
+	return readOnlyStore{store: store}
+}
+
+// Get Association with key of endpoint
+func (s readOnlyStore) Get(endpoint string) (Association, bool) {
+	return s.store.Get(endpoint)
+}
+
+// Set is ignored
+func (s readOnlyStore) Set(endpoint string, a Association) {
+	log.Printf("read-only association store: ignore set %s", endpoint)
+}
+
+// Delete is ignored
+func (s readOnlyStore) Delete(endpoint string) {
+	log.Printf("read-only association store: ignore delete %s", endpoint)
+}
@@ -0,0 +1,149 @@
+package openid
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ReadOnlyStore(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	expired := fakeAssociation(newCheckAuthProvider(t, false, "").URL)
+	expired.Expires = time.Now().Add(-time.Hour)
+
+	snapshot := &associations{}
+	snapshot.Set(assoc.Endpoint, *assoc)
+	snapshot.Set(expired.Endpoint, *expired)
+
+	o := New(realm)
+	serveDiscovery(o, assoc.Endpoint)
+	o.SetAssociationStore(ReadOnlyStore(snapshot))
+
+	if _, err := o.IDRes(idResRequest(t, assoc, nil)); err != nil {
+		t.Errorf("verify against snapshot: %v", err)
+	}
+
+	_, err := o.IDRes(idResRequest(t, expired, nil))
+	if !errors.Is(err, ErrDirectVerifyFailed) {
+		t.Errorf("expired association: %v, want %v", err, ErrDirectVerifyFailed)
+	}
+	if _, ok := snapshot.Get(expired.Endpoint); !ok {
+		t.Errorf("expired association evicted from read-only snapshot")
+	}
+
+	ts := newFakeProvider(t)
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot.Get(ts.URL); ok {
+		t.Errorf("new association stored in read-only snapshot")
+	}
+}
+
+func Test_New_Store(t *testing.T) {
+	ts := newFakeProvider(t)
+	shared := &associations{}
+
+	// the instance creating the association
+	if _, err := New(realm, shared).CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	assoc, ok := shared.Get(ts.URL)
+	if !ok {
+		t.Fatalf("association not stored in the shared store")
+	}
+
+	// another instance verifying the callback
+	o := New(realm, shared)
+	serveDiscovery(o, ts.URL)
+	if _, err := o.IDRes(idResRequest(t, &assoc, nil)); err != nil {
+		t.Errorf("verify with shared store: %v", err)
+	}
+
+	if _, ok := New(realm, nil).assocs.(*associations); !ok {
+		t.Errorf("nil store should default to memory")
+	}
+}
+
+func Test_associations_Concurrent(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+	serveDiscovery(o, ts.URL)
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	assoc, ok := o.association(ts.URL, 0)
+	if !ok {
+		t.Fatalf("no association stored")
+	}
+
+	requests := make([]*http.Request, 50)
+	for i := range requests {
+		requests[i] = idResRequest(t, assoc, nil)
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range requests {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(r *http.Request) {
+			defer wg.Done()
+			if _, err := o.IDRes(r); err != nil {
+				t.Error(err)
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+func Test_association_Expired(t *testing.T) {
+	ts := newFakeProvider(t)
+	o := New(realm)
+
+	now := time.Now()
+	o.now = func() time.Time { return now }
+
+	associations := 0
+	o.SetObserver(ObserverFunc(
+		func(phase Phase, endpoint string, d time.Duration, err error) {
+			if phase == PhaseAssociate {
+				associations++
+			}
+		}))
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	first, ok := o.assocs.Get(ts.URL)
+	if !ok {
+		t.Fatalf("no association stored")
+	}
+
+	// the fake OpenID Server associations expire in an hour
+	now = now.Add(2 * time.Hour)
+	if _, ok := o.association(ts.URL, 0); ok {
+		t.Errorf("expired association should be a miss")
+	}
+	if _, ok := o.assocs.Get(ts.URL); ok {
+		t.Errorf("expired association should be deleted")
+	}
+
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if associations != 2 {
+		t.Errorf("%d associations, want a renewal", associations)
+	}
+	renewed, ok := o.assocs.Get(ts.URL)
+	if !ok || !renewed.Expires.After(first.Expires) {
+		t.Errorf("association not renewed: %+v", renewed)
+	}
+}
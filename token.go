@@ -0,0 +1,122 @@
+package openid
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// KeyRing holds the keys signing tokens, like return_to nonces or state
+// tokens. The newest key signs while all keys verify, so keys can be rotated
+// without invalidating the tokens in flight.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys [][]byte
+}
+
+// NewKeyRing return a KeyRing of keys, from the oldest to the newest
+func NewKeyRing(keys ...[]byte) *KeyRing {
+	k := &KeyRing{}
+	for _, key := range keys {
+		k.Add(key)
+	}
+	return k
+}
+
+// Add key as the newest key, used for signing from now on
+func (k *KeyRing) Add(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = append(k.keys, key)
+}
+
+// Remove a retired key, tokens signed by it will not verify anymore
+func (k *KeyRing) Remove(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for i, kk := range k.keys {
+		if bytes.Equal(kk, key) {
+			k.keys = append(k.keys[:i:i], k.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sign data with the newest key, return the token "data.signature"
+func (k *KeyRing) Sign(data string) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if len(k.keys) == 0 {
+		return "", fmt.Errorf("no key to sign with")
+	}
+
+	mac := tokenMAC(k.keys[len(k.keys)-1], data)
+	return data + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// Verify token signed by any key, return the signed data
+func (k *KeyRing) Verify(token string) (string, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", false
+	}
+
+	data := token[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return "", false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if hmac.Equal(mac, tokenMAC(key, data)) {
+			return data, true
+		}
+	}
+	return "", false
+}
+
+// tokenMAC compute the HMAC-SHA256 of data with key
+func tokenMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// SetKeyRing set the keys signing tokens built by NewToken.
+func (o *OpenID) SetKeyRing(keys *KeyRing) {
+	o.keys = keys
+}
+
+// NewToken return a random token signed by the newest key of the KeyRing,
+// suitable as return_to nonce or login state.
+func (o *OpenID) NewToken() (string, error) {
+	if o.keys == nil {
+		return "", fmt.Errorf("no KeyRing set")
+	}
+
+	b, err := o.randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	return o.keys.Sign(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// VerifyToken report whether token was built by NewToken with any key of
+// the KeyRing.
+func (o *OpenID) VerifyToken(token string) bool {
+	if o.keys == nil {
+		return false
+	}
+	_, ok := o.keys.Verify(token)
+	return ok
+}
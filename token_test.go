@@ -0,0 +1,42 @@
+package openid
+
+import "testing"
+
+func Test_KeyRing_Rotation(t *testing.T) {
+	oldKey, newKey := []byte("old key"), []byte("new key")
+
+	o := New(realm)
+	keys := NewKeyRing(oldKey)
+	o.SetKeyRing(keys)
+
+	token, err := o.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Add(newKey)
+
+	if !o.VerifyToken(token) {
+		t.Errorf("token signed with the old key should still verify")
+	}
+
+	fresh, err := o.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewKeyRing(oldKey).Verify(fresh); ok {
+		t.Errorf("new tokens should be signed with the newest key")
+	}
+
+	keys.Remove(oldKey)
+
+	if o.VerifyToken(token) {
+		t.Errorf("token signed with a removed key should not verify")
+	}
+	if !o.VerifyToken(fresh) {
+		t.Errorf("token signed with the new key should verify")
+	}
+	if o.VerifyToken(fresh + "x") {
+		t.Errorf("tampered token should not verify")
+	}
+}
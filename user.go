@@ -0,0 +1,76 @@
+package openid
+
+import "net/http"
+
+// User is a verified user, with the SReg values or the AX ones when the
+// OpenID Server only returned AX.
+type User struct {
+	// ClaimedID is the verified identifier of the user.
+	ClaimedID string
+	// DisplayIdentifier is the identifier the user entered, to show as
+	// logged in, see Assertion.DisplayIdentifier.
+	DisplayIdentifier string
+	// Identity is the OP-Local identifier of the user.
+	Identity string
+	// OPEndpoint is the OpenID Server endpoint which asserted the user.
+	OPEndpoint string
+	// Nickname is the sreg nickname or the AX friendly name.
+	Nickname string
+	// Email is the sreg or AX email.
+	Email string
+	// FullName is the sreg fullname or the AX full name.
+	FullName string
+	// Raw holds the verified openid values, like IDRes returns.
+	Raw map[string]string
+}
+
+// userFields map the User fields to their sreg field and AX type
+var userFields = []struct {
+	sreg, axType string
+	field        func(u *User) *string
+}{
+	{"nickname", "http://axschema.org/namePerson/friendly",
+		func(u *User) *string { return &u.Nickname }},
+	{"email", axTypeEmail, func(u *User) *string { return &u.Email }},
+	{"fullname", "http://axschema.org/namePerson",
+		func(u *User) *string { return &u.FullName }},
+}
+
+// IDResUser handle the OpenID Server back redirection like IDRes, returning
+// the verified User. The setup_needed answer to CheckIDImmediate is returned
+// as ErrSetupNeeded.
+func (o *OpenID) IDResUser(r *http.Request) (*User, error) {
+	a, err := o.IDResAssertion(r)
+	if err != nil {
+		return nil, err
+	}
+	if a.SetupNeeded {
+		return nil, ErrSetupNeeded
+	}
+	return newUser(a), nil
+}
+
+// newUser get the User of the assertion a
+func newUser(a *Assertion) *User {
+	u := &User{
+		ClaimedID:         a.Values["claimed_id"],
+		DisplayIdentifier: a.DisplayIdentifier,
+		Identity:          a.Values["identity"],
+		OPEndpoint:        a.Values["op_endpoint"],
+		Raw:               a.Values,
+	}
+
+	// OpenID 1.1 has no claimed_id
+	if u.ClaimedID == "" {
+		u.ClaimedID = u.Identity
+	}
+
+	for _, f := range userFields {
+		if v, ok := a.Values["sreg."+f.sreg]; ok {
+			*f.field(u) = v
+		} else if v, ok := axValue(a.Values, a.AX, f.axType); ok {
+			*f.field(u) = v
+		}
+	}
+	return u
+}
@@ -0,0 +1,68 @@
+package openid
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func Test_IDResUser(t *testing.T) {
+	assoc := fakeAssociation("https://openidprovider.com/openid")
+	o := New(realm)
+	o.assocs.Set(assoc.Endpoint, *assoc)
+	serveDiscovery(o, assoc.Endpoint)
+
+	// nickname from sreg, email and full name from AX only
+	user, err := o.IDResUser(idResRequest(t, assoc, map[string]string{
+		"ns.sreg":         NSSreg,
+		"sreg.nickname":   "alice",
+		"ns.ext1":         NSAX,
+		"ext1.mode":       "fetch_response",
+		"ext1.type.mail":  axTypeEmail,
+		"ext1.value.mail": "alice@example.com",
+		"ext1.type.name":  "http://axschema.org/namePerson",
+		"ext1.value.name": "Alice Liddell",
+		"ext1.type.nick":  "http://axschema.org/namePerson/friendly",
+		"ext1.value.nick": "ax-alice",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := User{
+		ClaimedID:         "https://openidprovider.com/id/alice",
+		DisplayIdentifier: "https://openidprovider.com/id/alice",
+		Identity:          "https://openidprovider.com/id/alice",
+		OPEndpoint:        assoc.Endpoint,
+		Nickname:          "alice",
+		Email:             "alice@example.com",
+		FullName:          "Alice Liddell",
+	}
+	got := *user
+	got.Raw = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("user %+v, want %+v", got, want)
+	}
+	if user.Raw["sreg.nickname"] != "alice" {
+		t.Errorf("raw values not retained: %v", user.Raw)
+	}
+}
+
+func Test_IDResUser_SetupNeeded(t *testing.T) {
+	o := New(realm)
+
+	for _, q := range []string{
+		"openid.ns=" + url.QueryEscape(Namespace) + "&openid.mode=setup_needed",
+		"openid.mode=id_res&openid.user_setup_url=" +
+			url.QueryEscape("https://openidprovider.com/setup"),
+	} {
+		r := httptest.NewRequest(http.MethodGet, callbackPrefix+"?"+q, nil)
+		user, err := o.IDResUser(r)
+		if !errors.Is(err, ErrSetupNeeded) || user != nil {
+			t.Errorf("%s: user %v, error %v, want %v", q, user, err, ErrSetupNeeded)
+		}
+	}
+}
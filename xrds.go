@@ -0,0 +1,83 @@
+package openid
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// OpenID service types advertised by discovery
+const (
+	typeServer   = "http://specs.openid.net/auth/2.0/server"
+	typeSignon   = "http://specs.openid.net/auth/2.0/signon"
+	typeSignon11 = "http://openid.net/signon/1.1"
+	typeSignon10 = "http://openid.net/signon/1.0"
+
+	// typeReturnTo advertises the return_to urls accepted
+	typeReturnTo = "http://specs.openid.net/auth/2.0/return_to"
+)
+
+// ProtocolVersion is the OpenID protocol version supported by an OpenID
+// Server.
+type ProtocolVersion int
+
+const (
+	// Version20 is OpenID Authentication 2.0, the default.
+	Version20 ProtocolVersion = iota
+	// Version11 is OpenID Authentication 1.1.
+	Version11
+)
+
+// String return the version number
+func (v ProtocolVersion) String() string {
+	switch v {
+	case Version20:
+		return "2.0"
+	case Version11:
+		return "1.1"
+	default:
+		return fmt.Sprintf("ProtocolVersion(%d)", int(v))
+	}
+}
+
+// xrds is a Yadis XRDS document
+type xrds struct {
+	XRD []struct {
+		Service []xrdsService `xml:"Service"`
+	} `xml:"XRD"`
+}
+
+// xrdsService is a service element of a XRDS document
+type xrdsService struct {
+	Priority string   `xml:"priority,attr"`
+	Type     []string `xml:"Type"`
+	URI      []string `xml:"URI"`
+	LocalID  string   `xml:"LocalID"`
+}
+
+// parseXRDS get services from a XRDS document
+func parseXRDS(body []byte) ([]xrdsService, error) {
+	var doc xrds
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("invalid XRDS document: %w", err)
+	}
+
+	var services []xrdsService
+	for _, xrd := range doc.XRD {
+		services = append(services, xrd.Service...)
+	}
+	return services, nil
+}
+
+// protocolVersion detect the protocol version from advertised service types
+func protocolVersion(types []string) ProtocolVersion {
+	version := Version20
+	for _, t := range types {
+		switch t {
+		case typeServer, typeSignon:
+			return Version20
+		case typeSignon11, typeSignon10:
+			version = Version11
+		}
+	}
+	return version
+}
@@ -0,0 +1,132 @@
+package openid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var xrds11 = []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<xrds:XRDS xmlns:xrds="xri://$xrds" xmlns="xri://$xrd*($v*2.0)">
+  <XRD>
+    <Service priority="0">
+      <Type>http://openid.net/signon/1.1</Type>
+      <Type>http://openid.net/sreg/1.0</Type>
+      <URI>https://openidprovider.com/openid</URI>
+    </Service>
+  </XRD>
+</xrds:XRDS>`)
+
+func Test_protocolVersion_11(t *testing.T) {
+	services, err := parseXRDS(xrds11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("got %d services, want 1", len(services))
+	}
+
+	version := protocolVersion(services[0].Type)
+	if version != Version11 {
+		t.Fatalf("version %s, want %s", version, Version11)
+	}
+
+	ts := newFakeProvider(t)
+	o := New(realm)
+	o.SetProtocolVersion(ts.URL, version)
+
+	// OpenID 1.1 has no identifier_select to send
+	if _, err := o.CheckIDSetup(ts.URL, callbackPrefix); err == nil {
+		t.Errorf("OpenID 1.1 login without identifier should fail")
+	}
+}
+
+func Test_OpenID11(t *testing.T) {
+	op := newFakeProvider(t)
+	ds := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentTypeXRDS)
+			w.Write(bytes.Replace(xrds11,
+				[]byte("https://openidprovider.com/openid"), []byte(op.URL), 1))
+		}))
+	defer ds.Close()
+	claimedID := ds.URL + "/alice"
+
+	o := New(realm)
+	urlStr, err := o.CheckIDSetupIdentifier(
+		context.Background(), claimedID, callbackPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	for _, k := range []string{"openid.ns", "openid.realm", "openid.claimed_id"} {
+		if _, ok := q[k]; ok {
+			t.Errorf("%s should be absent in a 1.1 request", k)
+		}
+	}
+	if got := q.Get("openid.trust_root"); got != realm {
+		t.Errorf("openid.trust_root %q, want %q", got, realm)
+	}
+	if got := q.Get("openid.identity"); got != claimedID {
+		t.Errorf("openid.identity %q, want %q", got, claimedID)
+	}
+
+	// the OpenID 1.1 assertion has neither claimed_id nor op_endpoint
+	returnTo := q.Get("openid.return_to")
+	assertion := func(signed ...string) *http.Request {
+		p := map[string]string{
+			"mode":         "id_res",
+			"identity":     claimedID,
+			"return_to":    returnTo,
+			"assoc_handle": "fake-handle",
+		}
+		p["signed"] = strings.Join(signed, ",")
+		sig, err := fakeAssociation(op.URL).sign(p, signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p["sig"] = sig
+
+		v := url.Values{}
+		encodeHTTP(v, p)
+		return httptest.NewRequest(http.MethodGet, returnTo+"&"+v.Encode(), nil)
+	}
+
+	user, err := o.IDRes(assertion("mode", "identity", "return_to"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user["claimed_id"] != claimedID || user["op_endpoint"] != op.URL {
+		t.Errorf("claimed_id %q, op_endpoint %q, want %q, %q",
+			user["claimed_id"], user["op_endpoint"], claimedID, op.URL)
+	}
+
+	_, err = o.IDRes(assertion("mode", "identity", "return_to"))
+	if !errors.Is(err, ErrNonceReplayed) {
+		t.Errorf("replayed assertion: %v, want %v", err, ErrNonceReplayed)
+	}
+
+	_, err = o.IDRes(assertion("mode", "identity"))
+	if !errors.Is(err, ErrReturnToMismatch) {
+		t.Errorf("unsigned return_to: %v, want %v", err, ErrReturnToMismatch)
+	}
+
+	o = New(realm)
+	if _, _, err := o.Discover(claimedID); err != nil {
+		t.Fatal(err)
+	}
+	if got := o.EndpointVersion(op.URL); got != Version11 {
+		t.Errorf("discovered version %s, want %s", got, Version11)
+	}
+}